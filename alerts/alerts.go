@@ -0,0 +1,101 @@
+package alerts
+
+import (
+	"log"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+var channels []Channel
+
+func Register(channel Channel) {
+	channels = append(channels, channel)
+}
+
+// Evaluate checks the stock of a product in a machine against its low-stock
+// threshold, raising a new alert or resolving the open one.
+func Evaluate(machineID uuid.UUID, productID uuid.UUID) error {
+	inventory := models.Inventory{}
+	record := database.Instance.Where("machine_id = ? AND product_id = ?", machineID, productID).First(&inventory)
+	if record.Error != nil {
+		return record.Error
+	}
+	return evaluate(inventory)
+}
+
+// EvaluateAll evaluates every inventory with a threshold and retries the
+// delivery of open alerts that no channel accepted yet. An alert that fails
+// is logged and retried on the next run without holding up the others.
+func EvaluateAll() error {
+	inventories := []models.Inventory{}
+	record := database.Instance.Where("low_stock_threshold > 0").Find(&inventories)
+	if record.Error != nil {
+		return record.Error
+	}
+	for _, inventory := range inventories {
+		if err := evaluate(inventory); err != nil {
+			log.Printf("low stock alert for machine %s product %s: %s", inventory.MachineID, inventory.ProductID, err)
+		}
+	}
+
+	pending := []models.StockAlert{}
+	record = database.Instance.Where("resolved_at IS NULL AND notified_at IS NULL").Find(&pending)
+	if record.Error != nil {
+		return record.Error
+	}
+	for _, alert := range pending {
+		if err := notify(alert); err != nil {
+			log.Printf("low stock alert %d: %s", alert.ID, err)
+		}
+	}
+	return nil
+}
+
+func evaluate(inventory models.Inventory) error {
+	open := models.StockAlert{}
+	record := database.Instance.Where("machine_id = ? AND product_id = ? AND resolved_at IS NULL", inventory.MachineID, inventory.ProductID).Limit(1).Find(&open)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	low := inventory.LowStockThreshold > 0 && inventory.Available <= inventory.LowStockThreshold
+	if !low {
+		if open.ID == 0 {
+			return nil
+		}
+		return database.Instance.Model(&open).Update("resolved_at", time.Now()).Error
+	}
+	if open.ID != 0 {
+		return nil
+	}
+
+	alert := models.StockAlert{
+		MachineID: inventory.MachineID,
+		ProductID: inventory.ProductID,
+		Available: inventory.Available,
+		Threshold: inventory.LowStockThreshold,
+		RaisedAt:  time.Now(),
+	}
+	// a concurrent evaluation may have raised the same alert already
+	record = database.Instance.Clauses(clause.OnConflict{DoNothing: true}).Create(&alert)
+	if record.Error != nil {
+		return record.Error
+	}
+	if record.RowsAffected == 0 {
+		return nil
+	}
+	return notify(alert)
+}
+
+func notify(alert models.StockAlert) error {
+	for _, channel := range channels {
+		if err := channel.Send(alert); err != nil {
+			return err
+		}
+	}
+	return database.Instance.Model(&alert).Update("notified_at", time.Now()).Error
+}
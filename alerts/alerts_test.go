@@ -0,0 +1,163 @@
+package alerts
+
+import (
+	"encoding/json"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// receiver is a webhook endpoint that records the alerts it accepts and
+// can be made to fail.
+type receiver struct {
+	mu       sync.Mutex
+	failing  bool
+	received []models.StockAlert
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	alert := models.StockAlert{}
+	if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.received = append(r.received, alert)
+}
+
+func (r *receiver) fail(failing bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failing = failing
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.received)
+}
+
+// countFor returns how many of the received alerts are for a machine, as
+// EvaluateAll also delivers alerts other tests left behind.
+func (r *receiver) countFor(machineID uuid.UUID) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, alert := range r.received {
+		if alert.MachineID == machineID {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWebhookChannelSend(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	alert := models.StockAlert{ID: 7, MachineID: uuid.New(), ProductID: uuid.New(), Available: 1, Threshold: 2}
+	if err := NewWebhookChannel(server.URL).Send(alert); err != nil {
+		t.Fatal(err)
+	}
+	if r.count() != 1 {
+		t.Fatalf("received %d alerts, want 1", r.count())
+	}
+	got := r.received[0]
+	if got.ID != alert.ID || got.MachineID != alert.MachineID || got.ProductID != alert.ProductID || got.Available != 1 || got.Threshold != 2 {
+		t.Errorf("received %+v, want %+v", got, alert)
+	}
+
+	r.fail(true)
+	if err := NewWebhookChannel(server.URL).Send(alert); err == nil {
+		t.Error("a failing receiver was not reported")
+	}
+}
+
+// TestWebhookDelivery raises alerts against postgres, which is skipped
+// when VEDING_MACHINE_TEST_PSQL_DSN is not set.
+func TestWebhookDelivery(t *testing.T) {
+	dsn := os.Getenv("VEDING_MACHINE_TEST_PSQL_DSN")
+	if dsn == "" {
+		t.Skip("VEDING_MACHINE_TEST_PSQL_DSN is not set")
+	}
+	database.Connect(dsn)
+	database.Migrate("EUR")
+
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	registered := channels
+	channels = []Channel{NewWebhookChannel(server.URL)}
+	defer func() { channels = registered }()
+
+	inventory := models.Inventory{MachineID: uuid.New(), ProductID: uuid.New(), Available: 1, LowStockThreshold: 2}
+	if err := database.Instance.Create(&inventory).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Evaluate(inventory.MachineID, inventory.ProductID); err != nil {
+		t.Fatal(err)
+	}
+	if r.countFor(inventory.MachineID) != 1 {
+		t.Fatalf("received %d alerts, want 1", r.countFor(inventory.MachineID))
+	}
+
+	// the alert is still open, evaluating again must not send it twice
+	if err := Evaluate(inventory.MachineID, inventory.ProductID); err != nil {
+		t.Fatal(err)
+	}
+	if err := EvaluateAll(); err != nil {
+		t.Fatal(err)
+	}
+	if r.countFor(inventory.MachineID) != 1 {
+		t.Fatalf("received %d alerts for one open alert", r.countFor(inventory.MachineID))
+	}
+
+	r.fail(true)
+	failed := models.Inventory{MachineID: uuid.New(), ProductID: uuid.New(), Available: 0, LowStockThreshold: 3}
+	if err := database.Instance.Create(&failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Evaluate(failed.MachineID, failed.ProductID); err == nil {
+		t.Fatal("a failed delivery was not reported")
+	}
+	alert := models.StockAlert{}
+	if err := database.Instance.Where("machine_id = ? AND resolved_at IS NULL", failed.MachineID).First(&alert).Error; err != nil {
+		t.Fatal(err)
+	}
+	if alert.NotifiedAt != nil {
+		t.Fatal("an undelivered alert is marked as notified")
+	}
+	// a failing delivery is logged, it doesn't stop the other alerts
+	if err := EvaluateAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.fail(false)
+	if err := EvaluateAll(); err != nil {
+		t.Fatal(err)
+	}
+	if r.countFor(failed.MachineID) != 1 {
+		t.Fatalf("received %d alerts, want 1 after the retry", r.countFor(failed.MachineID))
+	}
+	if r.countFor(inventory.MachineID) != 1 {
+		t.Errorf("the delivered alert was sent again")
+	}
+	if err := database.Instance.First(&alert, alert.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if alert.NotifiedAt == nil {
+		t.Error("the retried alert is not marked as notified")
+	}
+}
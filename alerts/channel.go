@@ -0,0 +1,48 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+)
+
+// Channel delivers a raised stock alert to operators.
+type Channel interface {
+	Send(alert models.StockAlert) error
+}
+
+type LogChannel struct{}
+
+func (LogChannel) Send(alert models.StockAlert) error {
+	log.Printf("low stock: machine %s product %s has %d left (threshold %d)", alert.MachineID, alert.ProductID, alert.Available, alert.Threshold)
+	return nil
+}
+
+type WebhookChannel struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookChannel(url string) WebhookChannel {
+	return WebhookChannel{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w WebhookChannel) Send(alert models.StockAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	response, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return nil
+}
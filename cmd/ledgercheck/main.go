@@ -0,0 +1,35 @@
+// Command ledgercheck verifies that balances and revenue match the ledger.
+// It exits with status 1 when it finds a discrepancy.
+package main
+
+import (
+	"fmt"
+	"mvpmatch/veding-machine/config"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/ledger"
+	"os"
+
+	"github.com/caarlos0/env/v6"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	c := config.Config{}
+	if err := env.Parse(&c); err != nil {
+		panic(err)
+	}
+	database.Connect(c.DSN)
+
+	discrepancies, err := ledger.Check()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for _, discrepancy := range discrepancies {
+		fmt.Println(discrepancy)
+	}
+	if len(discrepancies) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("ledger is consistent")
+}
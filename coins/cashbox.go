@@ -0,0 +1,129 @@
+package coins
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrCashBoxShort = errors.New("machine does not hold these coins")
+
+// CashBox loads the coins of a currency a machine holds.
+func CashBox(tx *gorm.DB, machineID uuid.UUID, code string) (Set, error) {
+	rows := []models.CashBoxCoin{}
+	record := tx.Where("machine_id = ? AND currency = ? AND count > 0", machineID, code).Find(&rows)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	box := Set{}
+	for _, row := range rows {
+		box[row.Denomination] = row.Count
+	}
+	return box, nil
+}
+
+// Spendable loads the coins of a machine's cash box it can pay out to
+// userID, locking the cash box. Coins other buyers inserted and haven't
+// spent yet are in the cash box too, but they belong to those buyers until
+// they buy something. Their balances are only read, not locked, so that
+// buyers at the same machine don't lock each other's balances.
+func Spendable(tx *gorm.DB, machineID uuid.UUID, code string, userID uuid.UUID) (Set, error) {
+	box, err := CashBox(tx.Clauses(clause.Locking{Strength: "UPDATE"}), machineID, code)
+	if err != nil {
+		return nil, err
+	}
+	return withoutEscrow(tx, box, machineID, code, userID)
+}
+
+// Payable reads the coins of a machine's cash box it can pay out without
+// locking anything, for reports such as whether it needs exact change.
+func Payable(tx *gorm.DB, machineID uuid.UUID, code string) (Set, error) {
+	box, err := CashBox(tx, machineID, code)
+	if err != nil {
+		return nil, err
+	}
+	return withoutEscrow(tx, box, machineID, code, uuid.Nil)
+}
+
+// withoutEscrow removes the coins buyers other than userID hold at a machine
+// from its cash box.
+func withoutEscrow(tx *gorm.DB, box Set, machineID uuid.UUID, code string, userID uuid.UUID) (Set, error) {
+	escrow := []models.BalanceCoin{}
+	record := tx.Where("machine_id = ? AND currency = ? AND user_id <> ? AND count > 0", machineID, code, userID).Find(&escrow)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	for _, row := range escrow {
+		box[row.Denomination] -= row.Count
+		if box[row.Denomination] <= 0 {
+			delete(box, row.Denomination)
+		}
+	}
+	return box, nil
+}
+
+// Store adds coins to a machine's cash box.
+func Store(tx *gorm.DB, machineID uuid.UUID, code string, coins Set) error {
+	rows := []models.CashBoxCoin{}
+	for denomination, count := range coins {
+		if count > 0 {
+			rows = append(rows, models.CashBoxCoin{MachineID: machineID, Currency: code, Denomination: denomination, Count: count})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "machine_id"}, {Name: "currency"}, {Name: "denomination"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("cash_box_coins.count + excluded.count")}),
+	}).Create(&rows).Error
+}
+
+// Dispense removes coins from a machine's cash box, failing if it doesn't
+// hold all of them.
+func Dispense(tx *gorm.DB, machineID uuid.UUID, code string, coins Set) error {
+	for denomination, count := range coins {
+		if count <= 0 {
+			continue
+		}
+		record := tx.Model(&models.CashBoxCoin{}).
+			Where("machine_id = ? AND currency = ? AND denomination = ? AND count >= ?", machineID, code, denomination, count).
+			Update("count", gorm.Expr("count - ?", count))
+		if record.Error != nil {
+			return record.Error
+		}
+		if record.RowsAffected == 0 {
+			return ErrCashBoxShort
+		}
+	}
+	return nil
+}
+
+// Contains reports whether s holds at least the given coins.
+func (s Set) Contains(coins Set) bool {
+	for denomination, count := range coins {
+		if s[denomination] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// ExactChangeOnly reports whether a machine holding box could fail to give
+// change for some amount below its largest coin, in which case buyers
+// should insert the exact price.
+func ExactChangeOnly(code string, box Set) bool {
+	denominations := Denominations(code)
+	if len(denominations) == 0 {
+		return true
+	}
+	for amount := Smallest(code); amount < denominations[0]; amount += Smallest(code) {
+		if _, err := Change(code, amount, box); err != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package coins
+
+import (
+	"errors"
+	"fmt"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrCannotMakeChange = errors.New("cannot make change")
+	ErrOtherMachine     = errors.New("coins are deposited at another machine")
+)
+
+// Currency is a configured currency with its accepted coins, largest first.
+type Currency struct {
+	Code          string `json:"code"`
+	MinorUnits    int    `json:"minor_units"`
+	Denominations []int  `json:"denominations"`
+}
+
+// Default is the currency of machines, products and deposits that don't
+// name one.
+var Default = "EUR"
+
+var (
+	mu         sync.RWMutex
+	currencies = map[string]Currency{}
+)
+
+// Load reads the configured currencies and their denominations from the
+// database.
+func Load() error {
+	rows := []models.Currency{}
+	record := database.Instance.Find(&rows)
+	if record.Error != nil {
+		return record.Error
+	}
+	denominations := []models.Denomination{}
+	record = database.Instance.Order("value DESC").Find(&denominations)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	loaded := map[string]Currency{}
+	for _, row := range rows {
+		loaded[row.Code] = Currency{Code: row.Code, MinorUnits: row.MinorUnits, Denominations: []int{}}
+	}
+	for _, denomination := range denominations {
+		currency, ok := loaded[denomination.Currency]
+		if !ok {
+			continue
+		}
+		currency.Denominations = append(currency.Denominations, denomination.Value)
+		loaded[denomination.Currency] = currency
+	}
+	if len(loaded[Default].Denominations) == 0 {
+		return fmt.Errorf("no coin denominations configured for %s", Default)
+	}
+
+	mu.Lock()
+	currencies = loaded
+	mu.Unlock()
+	return nil
+}
+
+// Lookup returns a configured currency.
+func Lookup(code string) (Currency, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	currency, ok := currencies[code]
+	return currency, ok && len(currency.Denominations) > 0
+}
+
+// Currencies returns every configured currency ordered by code.
+func Currencies() []Currency {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]Currency, 0, len(currencies))
+	for _, currency := range currencies {
+		list = append(list, currency)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// Known reports whether coins of the currency are accepted.
+func Known(code string) bool {
+	_, ok := Lookup(code)
+	return ok
+}
+
+// Denominations returns the accepted coin values of a currency, largest
+// first.
+func Denominations(code string) []int {
+	currency, _ := Lookup(code)
+	return currency.Denominations
+}
+
+// Valid reports whether value is an accepted coin of the currency.
+func Valid(code string, value int) bool {
+	for _, denomination := range Denominations(code) {
+		if denomination == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Smallest returns the smallest accepted coin of a currency, which every
+// price in that currency has to be a multiple of.
+func Smallest(code string) int {
+	denominations := Denominations(code)
+	if len(denominations) == 0 {
+		return 1
+	}
+	return denominations[len(denominations)-1]
+}
+
+// Format renders an amount in minor units with the currency's decimals,
+// e.g. 150 EUR as "1.50 EUR" and 150 HUF as "150 HUF".
+func Format(code string, amount int) string {
+	currency, ok := Lookup(code)
+	if !ok || currency.MinorUnits == 0 {
+		return fmt.Sprintf("%d %s", amount, code)
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := fmt.Sprintf("%0*d", currency.MinorUnits+1, amount)
+	split := len(digits) - currency.MinorUnits
+	return fmt.Sprintf("%s%s.%s %s", sign, digits[:split], digits[split:], code)
+}
+
+// Set counts coins by denomination.
+type Set map[int]int
+
+func (s Set) Total() int {
+	total := 0
+	for denomination, count := range s {
+		total += denomination * count
+	}
+	return total
+}
+
+// List returns every coin in the set, largest first.
+func (s Set) List() []int {
+	values := make([]int, 0, len(s))
+	for denomination := range s {
+		values = append(values, denomination)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(values)))
+
+	list := []int{}
+	for _, denomination := range values {
+		for i := 0; i < s[denomination]; i++ {
+			list = append(list, denomination)
+		}
+	}
+	return list
+}
+
+// Change pays amount with as few coins as possible using only the coins
+// available. Greedy largest-first fails with limited supply (15 from 20s,
+// 10s and 5s when the 10s ran out), so this solves it exactly as a bounded
+// knapsack: each denomination's supply is split into bundles of 1, 2, 4, …
+// coins, each bundle taken at most once.
+func Change(code string, amount int, available Set) (Set, error) {
+	if amount < 0 {
+		return nil, ErrCannotMakeChange
+	}
+	change := Set{}
+	if amount == 0 {
+		return change, nil
+	}
+
+	type bundle struct {
+		denomination int
+		count        int
+	}
+	bundles := []bundle{}
+	for _, denomination := range Denominations(code) {
+		supply := available[denomination]
+		if supply > amount/denomination {
+			supply = amount / denomination
+		}
+		for size := 1; supply > 0; size *= 2 {
+			if size > supply {
+				size = supply
+			}
+			bundles = append(bundles, bundle{denomination, size})
+			supply -= size
+		}
+	}
+
+	const unreachable = int(^uint(0) >> 1)
+	fewest := make([]int, amount+1)
+	for i := 1; i <= amount; i++ {
+		fewest[i] = unreachable
+	}
+	taken := make([][]bool, len(bundles))
+	for i, b := range bundles {
+		taken[i] = make([]bool, amount+1)
+		value := b.denomination * b.count
+		for total := amount; total >= value; total-- {
+			if fewest[total-value] == unreachable {
+				continue
+			}
+			if coins := fewest[total-value] + b.count; coins < fewest[total] {
+				fewest[total] = coins
+				taken[i][total] = true
+			}
+		}
+	}
+	if fewest[amount] == unreachable {
+		return nil, ErrCannotMakeChange
+	}
+
+	for i := len(bundles) - 1; i >= 0 && amount > 0; i-- {
+		if taken[i][amount] {
+			change[bundles[i].denomination] += bundles[i].count
+			amount -= bundles[i].denomination * bundles[i].count
+		}
+	}
+	return change, nil
+}
+
+// Balance loads the coins of a currency a buyer has deposited.
+func Balance(tx *gorm.DB, userID uuid.UUID, code string) (Set, error) {
+	rows := []models.BalanceCoin{}
+	record := tx.Where("user_id = ? AND currency = ? AND count > 0", userID, code).Find(&rows)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	balance := Set{}
+	for _, row := range rows {
+		balance[row.Denomination] = row.Count
+	}
+	return balance, nil
+}
+
+// Balances loads every coin a buyer has deposited, by currency.
+func Balances(tx *gorm.DB, userID uuid.UUID) (map[string]Set, error) {
+	rows := []models.BalanceCoin{}
+	record := tx.Where("user_id = ? AND count > 0", userID).Find(&rows)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	balances := map[string]Set{}
+	for _, row := range rows {
+		if balances[row.Currency] == nil {
+			balances[row.Currency] = Set{}
+		}
+		balances[row.Currency][row.Denomination] = row.Count
+	}
+	return balances, nil
+}
+
+// DepositedAt returns the machine whose cash box holds a buyer's balance
+// in a currency, which is nil when the buyer holds no coins or only coins
+// from before deposits were made at machines.
+func DepositedAt(tx *gorm.DB, userID uuid.UUID, code string) (uuid.UUID, error) {
+	rows := []models.BalanceCoin{}
+	record := tx.Where("user_id = ? AND currency = ? AND count > 0 AND machine_id <> ?", userID, code, uuid.Nil).Limit(1).Find(&rows)
+	if record.Error != nil || len(rows) == 0 {
+		return uuid.Nil, record.Error
+	}
+	return rows[0].MachineID, nil
+}
+
+// Deposit adds count coins of a denomination inserted at a machine to a
+// buyer's balance.
+func Deposit(tx *gorm.DB, userID uuid.UUID, machineID uuid.UUID, code string, denomination int, count int) error {
+	return Add(tx, userID, machineID, code, Set{denomination: count})
+}
+
+// Add adds coins inserted at a machine to a buyer's balance. A balance is
+// held by one machine at a time, so coins can't be added while the buyer
+// has coins in another machine.
+func Add(tx *gorm.DB, userID uuid.UUID, machineID uuid.UUID, code string, coins Set) error {
+	rows := []models.BalanceCoin{}
+	for denomination, count := range coins {
+		if count != 0 {
+			rows = append(rows, models.BalanceCoin{UserID: userID, Currency: code, Denomination: denomination, Count: count, MachineID: machineID})
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	depositedAt, err := DepositedAt(tx, userID, code)
+	if err != nil {
+		return err
+	}
+	if depositedAt != uuid.Nil && depositedAt != machineID {
+		return ErrOtherMachine
+	}
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "currency"}, {Name: "denomination"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("balance_coins.count + excluded.count")}),
+	}).Create(&rows).Error
+	if err != nil || depositedAt == machineID {
+		return err
+	}
+	// coins from before deposits were made at machines move along
+	return tx.Model(&models.BalanceCoin{}).Where("user_id = ? AND currency = ?", userID, code).Update("machine_id", machineID).Error
+}
+
+// SetBalance replaces a buyer's balance in a currency with the given coins,
+// held by a machine.
+func SetBalance(tx *gorm.DB, userID uuid.UUID, machineID uuid.UUID, code string, balance Set) error {
+	if err := Empty(tx, userID, code); err != nil {
+		return err
+	}
+	return Add(tx, userID, machineID, code, balance)
+}
+
+// Empty removes every coin of a currency from a buyer's balance.
+func Empty(tx *gorm.DB, userID uuid.UUID, code string) error {
+	return tx.Where("user_id = ? AND currency = ?", userID, code).Delete(&models.BalanceCoin{}).Error
+}
+
+// Withdraw removes every coin of a currency from a buyer's balance and
+// returns what was removed, in one statement.
+func Withdraw(tx *gorm.DB, userID uuid.UUID, code string) (Set, error) {
+	rows := []models.BalanceCoin{}
+	record := tx.Clauses(clause.Returning{}).Where("user_id = ? AND currency = ?", userID, code).Delete(&rows)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	withdrawn := Set{}
+	for _, row := range rows {
+		if row.Count > 0 {
+			withdrawn[row.Denomination] += row.Count
+		}
+	}
+	return withdrawn, nil
+}
+
+// OrDefault returns code, or the default currency when code is empty.
+func OrDefault(code string) string {
+	if code == "" {
+		return Default
+	}
+	return code
+}
@@ -0,0 +1,99 @@
+package coins
+
+import (
+	"errors"
+	"testing"
+)
+
+var testDenominations = []int{200, 100, 50, 20, 10, 5, 2, 1}
+
+func useCurrencies() {
+	currencies = map[string]Currency{
+		"EUR": {Code: "EUR", MinorUnits: 2, Denominations: testDenominations},
+		"XTS": {Code: "XTS", Denominations: []int{100, 50, 20, 10, 5}},
+	}
+}
+
+// fewestCoins finds the smallest number of coins paying amount out of
+// available by trying every combination, or -1 if there is none.
+func fewestCoins(denominations []int, amount int, available Set) int {
+	if amount == 0 {
+		return 0
+	}
+	if len(denominations) == 0 {
+		return -1
+	}
+	best := -1
+	denomination := denominations[0]
+	for count := 0; count <= available[denomination] && count*denomination <= amount; count++ {
+		rest := fewestCoins(denominations[1:], amount-count*denomination, available)
+		if rest >= 0 && (best < 0 || count+rest < best) {
+			best = count + rest
+		}
+	}
+	return best
+}
+
+func checkChange(t *testing.T, code string, amount int, available Set) {
+	t.Helper()
+	change, err := Change(code, amount, available)
+	want := fewestCoins(Denominations(code), amount, available)
+	if want < 0 {
+		if !errors.Is(err, ErrCannotMakeChange) {
+			t.Fatalf("Change(%d, %v) = %v, %v; want ErrCannotMakeChange", amount, available, change, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Change(%d, %v) failed: %v; want %d coins", amount, available, err, want)
+	}
+	if change.Total() != amount {
+		t.Fatalf("Change(%d, %v) = %v, totals %d", amount, available, change, change.Total())
+	}
+	if !available.Contains(change) {
+		t.Fatalf("Change(%d, %v) = %v, uses coins that are not available", amount, available, change)
+	}
+	if got := len(change.List()); got != want {
+		t.Fatalf("Change(%d, %v) = %v, %d coins; want %d", amount, available, change, got, want)
+	}
+}
+
+func TestChangeWithoutTens(t *testing.T) {
+	useCurrencies()
+	// greedy would take a 20 for 35 and get stuck on 15 without 10s
+	change, err := Change("XTS", 35, Set{20: 5, 5: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change[20] != 1 || change[5] != 3 {
+		t.Fatalf("got %v, want one 20 and three 5s", change)
+	}
+	checkChange(t, "XTS", 15, Set{20: 5, 5: 5})
+	checkChange(t, "XTS", 60, Set{50: 1, 20: 3})
+}
+
+func TestChangeCannotBeMade(t *testing.T) {
+	useCurrencies()
+	if _, err := Change("XTS", 15, Set{20: 5, 10: 1}); !errors.Is(err, ErrCannotMakeChange) {
+		t.Fatalf("got %v, want ErrCannotMakeChange", err)
+	}
+	if _, err := Change("XTS", -5, Set{5: 1}); !errors.Is(err, ErrCannotMakeChange) {
+		t.Fatalf("got %v, want ErrCannotMakeChange", err)
+	}
+}
+
+func FuzzChange(f *testing.F) {
+	f.Add(uint16(35), uint8(0), uint8(0), uint8(5), uint8(0), uint8(5), uint8(0), uint8(0), uint8(0))
+	f.Add(uint16(15), uint8(0), uint8(0), uint8(0), uint8(5), uint8(0), uint8(5), uint8(0), uint8(0))
+	f.Add(uint16(399), uint8(1), uint8(1), uint8(1), uint8(1), uint8(1), uint8(1), uint8(1), uint8(1))
+	f.Add(uint16(6), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(1), uint8(3), uint8(0))
+	f.Fuzz(func(t *testing.T, amount uint16, c200, c100, c50, c20, c10, c5, c2, c1 uint8) {
+		useCurrencies()
+		// small supplies and amounts keep the exhaustive search fast
+		available := Set{}
+		for i, count := range []uint8{c200, c100, c50, c20, c10, c5, c2, c1} {
+			available[testDenominations[i]] = int(count % 6)
+		}
+		checkChange(t, "EUR", int(amount%500), available)
+	})
+}
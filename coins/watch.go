@@ -0,0 +1,46 @@
+package coins
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	watchersMu sync.Mutex
+	watchers   = map[uuid.UUID]map[chan struct{}]bool{}
+)
+
+// Watch returns a channel that receives a value whenever the buyer's balance
+// changed, and a function to stop watching.
+func Watch(userID uuid.UUID) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	watchersMu.Lock()
+	if watchers[userID] == nil {
+		watchers[userID] = map[chan struct{}]bool{}
+	}
+	watchers[userID][ch] = true
+	watchersMu.Unlock()
+
+	return ch, func() {
+		watchersMu.Lock()
+		delete(watchers[userID], ch)
+		if len(watchers[userID]) == 0 {
+			delete(watchers, userID)
+		}
+		watchersMu.Unlock()
+	}
+}
+
+// Changed wakes everyone watching the buyer's balance. Call it once the
+// change is committed.
+func Changed(userID uuid.UUID) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+	for ch := range watchers[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
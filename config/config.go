@@ -1,6 +1,22 @@
 package config
 
+import "time"
+
 type Config struct {
-	DSN string `env:"VEDING_MACHINE_PSQL_DSN"`
-	Port string `env:"VEDING_MACHINE_PORT"`
-}
\ No newline at end of file
+	DSN                 string        `env:"VEDING_MACHINE_PSQL_DSN"`
+	Port                string        `env:"VEDING_MACHINE_PORT"`
+	AlertWebhookURL     string        `env:"VEDING_MACHINE_ALERT_WEBHOOK_URL"`
+	AlertInterval       time.Duration `env:"VEDING_MACHINE_ALERT_INTERVAL" envDefault:"5m"`
+	PriceInterval       time.Duration `env:"VEDING_MACHINE_PRICE_INTERVAL" envDefault:"1m"`
+	ReservationTTL      time.Duration `env:"VEDING_MACHINE_RESERVATION_TTL" envDefault:"2m"`
+	ReservationMaxTTL   time.Duration `env:"VEDING_MACHINE_RESERVATION_MAX_TTL" envDefault:"10m"`
+	ReservationInterval time.Duration `env:"VEDING_MACHINE_RESERVATION_INTERVAL" envDefault:"15s"`
+	Currency            string        `env:"VEDING_MACHINE_CURRENCY" envDefault:"EUR"`
+	CurrencyMinorUnits  int           `env:"VEDING_MACHINE_CURRENCY_MINOR_UNITS" envDefault:"2"`
+	IdempotencyTTL      time.Duration `env:"VEDING_MACHINE_IDEMPOTENCY_TTL" envDefault:"24h"`
+	IdempotencyInterval time.Duration `env:"VEDING_MACHINE_IDEMPOTENCY_INTERVAL" envDefault:"1h"`
+	IdempotencyStuck    time.Duration `env:"VEDING_MACHINE_IDEMPOTENCY_STUCK_AFTER" envDefault:"60s"`
+	Coins               []int         `env:"VEDING_MACHINE_COINS" envDefault:"5,10,20,50,100" envSeparator:","`
+	AdminUsername       string        `env:"VEDING_MACHINE_ADMIN_USERNAME"`
+	AdminPassword       string        `env:"VEDING_MACHINE_ADMIN_PASSWORD"`
+}
@@ -2,17 +2,47 @@ package controllers
 
 import (
 	"errors"
+	"io"
 	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
 	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/ledger"
 	"mvpmatch/veding-machine/models"
 	"net/http"
+	"reflect"
+	"sort"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
+// balanceRefresh is how often a balance stream re-reads the balance, to
+// pick up deposits handled by another instance.
+const balanceRefresh = 5 * time.Second
+
+// errOtherMachine is reported when a buyer uses a machine while their coins
+// are in another one.
+var errOtherMachine = errors.New("your coins are in another machine, buy there or reset your deposit there first")
+
+type CoinCount struct {
+	Denomination int `json:"denomination"`
+	Count        int `json:"count"`
+}
+
+type BalanceView struct {
+	Currency       string      `json:"currency"`
+	Total          int         `json:"total"`
+	TotalFormatted string      `json:"total_formatted"`
+	Coins          []CoinCount `json:"coins"`
+}
+
 type DepositRequest struct {
-	Amount int `json:"amount" binding:"eq=5|eq=10|eq=20|eq=50|eq=100"`
+	Amount    int       `json:"amount" binding:"required,min=1"`
+	Currency  string    `json:"currency" binding:"omitempty,iso4217"`
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
 }
 
 func Deposit(context *gin.Context) {
@@ -30,6 +60,17 @@ func Deposit(context *gin.Context) {
 		return
 	}
 
+	currency, status, err := depositCurrency(deposit.MachineID, deposit.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	deposit.Currency = currency
+	if !coins.Valid(deposit.Currency, deposit.Amount) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "coin not accepted", "accepted": coins.Denominations(deposit.Currency)})
+		return
+	}
+
 	claims, err := auth.GetClaimsFromToken(token)
 	if err != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -37,36 +78,108 @@ func Deposit(context *gin.Context) {
 		return
 	}
 
-	balance := &models.Balance{UserID: claims.UserID}
-	record := database.Instance.Where("user_id = ? ", claims.UserID).First(&balance)
-	if record.Error != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		if err := coins.Deposit(tx, claims.UserID, deposit.MachineID, deposit.Currency, deposit.Amount, 1); err != nil {
+			return err
+		}
+		if err := coins.Store(tx, deposit.MachineID, deposit.Currency, coins.Set{deposit.Amount: 1}); err != nil {
+			return err
+		}
+		return ledger.Deposit(tx, claims.UserID, deposit.MachineID, deposit.Currency, deposit.Amount)
+	})
+	if errors.Is(err, coins.ErrOtherMachine) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": errOtherMachine.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		context.Abort()
 		return
 	}
+	coins.Changed(claims.UserID)
+	context.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+type BatchDepositRequest struct {
+	Coins     []int     `json:"coins" binding:"required,min=1,max=100"`
+	Currency  string    `json:"currency" binding:"omitempty,iso4217"`
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+}
+
+// DepositBatch adds every coin a coin acceptor reported at once. If any
+// coin isn't accepted, none of them are deposited.
+func DepositBatch(context *gin.Context) {
+	token := auth.GetToken(context)
+	var deposit BatchDepositRequest
+	if err := context.ShouldBindJSON(&deposit); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
 
-	switch deposit.Amount {
-	case 5:
-		balance.FIVE++
-	case 10:
-		balance.TEN++
-	case 20:
-		balance.TWENTY++
-	case 50:
-		balance.FIFTY++
-	case 100:
-		balance.HUNDRED++
+	currency, status, err := depositCurrency(deposit.MachineID, deposit.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	deposit.Currency = currency
+	batch := coins.Set{}
+	rejected := []int{}
+	for _, coin := range deposit.Coins {
+		if !coins.Valid(deposit.Currency, coin) {
+			rejected = append(rejected, coin)
+			continue
+		}
+		batch[coin]++
+	}
+	if len(rejected) > 0 {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "coin not accepted", "rejected": rejected, "accepted": coins.Denominations(deposit.Currency)})
+		return
 	}
 
-	record = database.Instance.Where("user_id = ? ", claims.UserID).Save(&balance)
-	if record.Error != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
-		context.Abort()
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"ok": true})
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		if err := coins.Add(tx, claims.UserID, deposit.MachineID, deposit.Currency, batch); err != nil {
+			return err
+		}
+		if err := coins.Store(tx, deposit.MachineID, deposit.Currency, batch); err != nil {
+			return err
+		}
+		return ledger.Deposit(tx, claims.UserID, deposit.MachineID, deposit.Currency, batch.Total())
+	})
+	if errors.Is(err, coins.ErrOtherMachine) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": errOtherMachine.Error()})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	coins.Changed(claims.UserID)
+
+	balances, err := balanceViews(claims.UserID, deposit.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"deposited": batch.Total(), "balance": balances[0]})
 }
 
+// ResetDeposit hands back every coin of a currency the buyer deposited at a
+// machine, returning the coins to eject.
 func ResetDeposit(context *gin.Context) {
 	token := auth.GetToken(context)
 	claims, err := auth.GetClaimsFromToken(token)
@@ -77,11 +190,212 @@ func ResetDeposit(context *gin.Context) {
 		return
 	}
 
-	record := database.Instance.Model(&models.Balance{}).Where("user_id = ? ", claims.UserID).Update("FIVE", 0).Update("TEN", 0).Update("TWENTY", 0).Update("FIFTY", 0).Update("HUNDRED", 0)
-	if record.Error != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+	if context.Query("machine_id") == "" {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing machine id"})
+		return
+	}
+	machineID, err := uuid.Parse(context.Query("machine_id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid machine id"})
+		return
+	}
+	currency, status, err := depositCurrency(machineID, context.Query("currency"))
+	if err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	refund := models.Refund{ID: uuid.New(), UserID: claims.UserID, Currency: currency}
+	var ejected coins.Set
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		depositedAt, err := coins.DepositedAt(tx, claims.UserID, currency)
+		if err != nil {
+			return err
+		}
+		if depositedAt != uuid.Nil && depositedAt != machineID {
+			return coins.ErrOtherMachine
+		}
+		withdrawn, err := coins.Withdraw(tx, claims.UserID, currency)
+		if err != nil || len(withdrawn) == 0 {
+			ejected = withdrawn
+			return err
+		}
+		ejected, err = ejectFromCashBox(tx, claims.UserID, machineID, currency, withdrawn)
+		if err != nil {
+			return err
+		}
+		refund.Amount = ejected.Total()
+		for _, coin := range ejected.List() {
+			refund.Coins = append(refund.Coins, int64(coin))
+		}
+		if err := tx.Create(&refund).Error; err != nil {
+			return err
+		}
+		return ledger.Refund(tx, refund, machineID)
+	})
+	if errors.Is(err, coins.ErrCannotMakeChange) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the machine cannot pay back your deposit", "code": "exact_change_required"})
+		return
+	}
+	if errors.Is(err, coins.ErrOtherMachine) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": errOtherMachine.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		context.Abort()
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"ok": true})
+	coins.Changed(claims.UserID)
+
+	response := gin.H{"currency": currency, "refunded": ejected.Total(), "change": ejected.List()}
+	if refund.Amount > 0 {
+		response["refund_id"] = refund.ID
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// ejectFromCashBox takes the coins to hand back for a withdrawn balance out
+// of the machine's cash box: the coins the buyer inserted when the machine
+// still holds them, otherwise the same amount in coins that don't belong to
+// other buyers.
+func ejectFromCashBox(tx *gorm.DB, userID uuid.UUID, machineID uuid.UUID, currency string, withdrawn coins.Set) (coins.Set, error) {
+	box, err := coins.Spendable(tx, machineID, currency, userID)
+	if err != nil {
+		return nil, err
+	}
+	ejected := withdrawn
+	if !box.Contains(withdrawn) {
+		ejected, err = coins.Change(currency, withdrawn.Total(), box)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ejected, coins.Dispense(tx, machineID, currency, ejected)
+}
+
+// depositCurrency returns the currency of coins inserted at a machine,
+// which defaults to the one the machine takes.
+func depositCurrency(machineID uuid.UUID, currency string) (string, int, error) {
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ?", machineID).First(&machine)
+	if record.Error != nil {
+		return "", http.StatusNotFound, errors.New("machine not found")
+	}
+	if currency != "" && currency != machine.Currency {
+		return "", http.StatusBadRequest, errors.New("the machine takes " + machine.Currency + " coins")
+	}
+	return machine.Currency, http.StatusOK, nil
+}
+
+func GetBalance(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	balances, err := balanceViews(claims.UserID, context.Query("currency"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"balances": balances})
+}
+
+// StreamBalance sends the balance as server-sent events, once when the
+// stream opens and again whenever it changes.
+func StreamBalance(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	currency := context.Query("currency")
+
+	changed, stop := coins.Watch(claims.UserID)
+	defer stop()
+	ticker := time.NewTicker(balanceRefresh)
+	defer ticker.Stop()
+
+	var last []BalanceView
+	send := func() bool {
+		balances, err := balanceViews(claims.UserID, currency)
+		if err != nil {
+			context.SSEvent("error", gin.H{"error": err.Error()})
+			return false
+		}
+		if last == nil || !reflect.DeepEqual(balances, last) {
+			context.SSEvent("balance", gin.H{"balances": balances})
+			last = balances
+		}
+		return true
+	}
+
+	context.Header("Cache-Control", "no-cache")
+	context.Header("X-Accel-Buffering", "no")
+	if !send() {
+		return
+	}
+	context.Writer.Flush()
+	context.Stream(func(w io.Writer) bool {
+		select {
+		case <-context.Request.Context().Done():
+			return false
+		case <-changed:
+		case <-ticker.C:
+		}
+		return send()
+	})
+}
+
+// balanceViews returns the buyer's balance in one currency, or in every
+// currency they hold coins in when currency is empty. Every accepted coin is
+// listed, including those the buyer has none of.
+func balanceViews(userID uuid.UUID, currency string) ([]BalanceView, error) {
+	balances, err := coins.Balances(database.Instance, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := []string{}
+	if currency != "" {
+		codes = append(codes, currency)
+	} else {
+		for code := range balances {
+			codes = append(codes, code)
+		}
+		if len(codes) == 0 {
+			codes = append(codes, coins.Default)
+		}
+		sort.Strings(codes)
+	}
+
+	views := []BalanceView{}
+	for _, code := range codes {
+		balance := balances[code]
+		counts := []CoinCount{}
+		seen := map[int]bool{}
+		for _, denomination := range coins.Denominations(code) {
+			counts = append(counts, CoinCount{denomination, balance[denomination]})
+			seen[denomination] = true
+		}
+		// coins that are no longer accepted are still part of the balance
+		for denomination, count := range balance {
+			if !seen[denomination] {
+				counts = append(counts, CoinCount{denomination, count})
+			}
+		}
+		sort.Slice(counts, func(i, j int) bool { return counts[i].Denomination > counts[j].Denomination })
+
+		views = append(views, BalanceView{
+			Currency:       code,
+			Total:          balance.Total(),
+			TotalFormatted: coins.Format(code, balance.Total()),
+			Coins:          counts,
+		})
+	}
+	return views, nil
 }
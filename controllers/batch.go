@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const bestBeforeLayout = "2006-01-02"
+
+var errStockExpired = errors.New("remaining stock of this product is expired")
+
+type ExpiringBatch struct {
+	models.StockBatch
+	Expired bool `json:"expired"`
+}
+
+func GetExpiringStock(context *gin.Context) {
+	token := auth.GetToken(context)
+	days := 3
+	if value := context.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 365 {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid days"})
+			return
+		}
+		days = parsed
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	today := startOfDay(time.Now())
+	batches := []models.StockBatch{}
+	record := database.Instance.
+		Where(
+			"(product_id IN (?) OR machine_id IN (?))",
+			database.Instance.Model(&models.Product{}).Select("id").Where("seller_id = ?", claims.UserID),
+			database.Instance.Model(&models.Machine{}).Select("id").Where("operator_id = ?", claims.UserID),
+		).
+		Where("quantity > 0 AND best_before < ?", today.AddDate(0, 0, days+1)).
+		Order("best_before, machine_id").
+		Find(&batches)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+
+	report := []ExpiringBatch{}
+	for _, batch := range batches {
+		report = append(report, ExpiringBatch{batch, batch.BestBefore.Before(today)})
+	}
+	context.JSON(http.StatusOK, gin.H{"days": days, "batches": report})
+}
+
+// applyBatches keeps the stock batches of a machine in step with a stock
+// movement: stock coming in opens a new batch, stock going out depletes the
+// batches first-in, first-out. Sales skip expired batches and are refused
+// when only expired stock is left. It returns how much was taken out of
+// each depleted batch.
+func applyBatches(tx *gorm.DB, movement *models.StockMovement) ([]models.StockBatch, error) {
+	if movement.Quantity > 0 {
+		batch := models.StockBatch{
+			MachineID:  movement.MachineID,
+			ProductID:  movement.ProductID,
+			LotNumber:  movement.LotNumber,
+			BestBefore: movement.BestBefore,
+			Quantity:   movement.Quantity,
+		}
+		return nil, tx.Create(&batch).Error
+	}
+
+	today := startOfDay(time.Now())
+	query := tx.Where("machine_id = ? AND product_id = ? AND quantity > 0", movement.MachineID, movement.ProductID)
+	if movement.Kind == models.MovementSale {
+		inventory := models.Inventory{}
+		record := tx.Where("machine_id = ? AND product_id = ?", movement.MachineID, movement.ProductID).First(&inventory)
+		if record.Error != nil {
+			return nil, record.Error
+		}
+		var expired int
+		record = tx.Model(&models.StockBatch{}).Select("COALESCE(SUM(quantity), 0)").
+			Where("machine_id = ? AND product_id = ? AND best_before < ?", movement.MachineID, movement.ProductID, today).
+			Scan(&expired)
+		if record.Error != nil {
+			return nil, record.Error
+		}
+		if inventory.Available >= -movement.Quantity && inventory.Available-expired < -movement.Quantity {
+			return nil, errStockExpired
+		}
+		query = query.Where("(best_before IS NULL OR best_before >= ?)", today)
+	}
+
+	batches := []models.StockBatch{}
+	record := query.Order("best_before ASC NULLS LAST, id").Find(&batches)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+
+	// stock received before batches were tracked has no batch, so running
+	// out of batches is not an error
+	taken := []models.StockBatch{}
+	remaining := -movement.Quantity
+	for _, batch := range batches {
+		if remaining == 0 {
+			break
+		}
+		quantity := batch.Quantity
+		if quantity > remaining {
+			quantity = remaining
+		}
+		record = tx.Model(&batch).Update("quantity", batch.Quantity-quantity)
+		if record.Error != nil {
+			return nil, record.Error
+		}
+		remaining -= quantity
+		batch.Quantity = quantity
+		taken = append(taken, batch)
+	}
+	return taken, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/ledger"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	errCoinNotAccepted = errors.New("coin not accepted")
+	errCoinsInEscrow   = errors.New("buyers deposited these coins and haven't spent them yet")
+)
+
+type CashBoxRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	Coins     []int     `json:"coins" binding:"required,min=1,max=1000"`
+	Collect   bool      `json:"collect"`
+}
+
+func GetCashBox(context *gin.Context) {
+	token := auth.GetToken(context)
+	machineID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid machine id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ? AND operator_id = ?", machineID, claims.UserID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to view this machine"})
+		return
+	}
+
+	box, err := coins.CashBox(database.Instance, machine.ID, machine.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	payable, err := coins.Payable(database.Instance, machine.ID, machine.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	counts := []CoinCount{}
+	for _, denomination := range coins.Denominations(machine.Currency) {
+		counts = append(counts, CoinCount{denomination, box[denomination]})
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"machine_id":        machine.ID,
+		"currency":          machine.Currency,
+		"total":             box.Total(),
+		"total_formatted":   coins.Format(machine.Currency, box.Total()),
+		"coins":             counts,
+		"exact_change_only": coins.ExactChangeOnly(machine.Currency, payable),
+	})
+}
+
+// AdjustCashBox records coins an operator floated into a machine, or
+// collected from it.
+func AdjustCashBox(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq CashBoxRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ? AND operator_id = ?", rq.MachineID, claims.UserID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this machine"})
+		return
+	}
+
+	adjusted := coins.Set{}
+	for _, coin := range rq.Coins {
+		adjusted[coin]++
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		if rq.Collect {
+			// the deposits of buyers stay in the machine until they buy
+			// something or take them back
+			spendable, err := coins.Spendable(tx, machine.ID, machine.Currency, uuid.Nil)
+			if err != nil {
+				return err
+			}
+			if !spendable.Contains(adjusted) {
+				return errCoinsInEscrow
+			}
+			if err := coins.Dispense(tx, machine.ID, machine.Currency, adjusted); err != nil {
+				return err
+			}
+			return ledger.CashBox(tx, machine.ID, claims.UserID, machine.Currency, -adjusted.Total())
+		}
+		for coin := range adjusted {
+			if !coins.Valid(machine.Currency, coin) {
+				return errCoinNotAccepted
+			}
+		}
+		if err := coins.Store(tx, machine.ID, machine.Currency, adjusted); err != nil {
+			return err
+		}
+		return ledger.CashBox(tx, machine.ID, claims.UserID, machine.Currency, adjusted.Total())
+	})
+	if errors.Is(err, coins.ErrCashBoxShort) || errors.Is(err, errCoinsInEscrow) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errCoinNotAccepted) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "accepted": coins.Denominations(machine.Currency)})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	box, err := coins.CashBox(database.Instance, machine.ID, machine.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	payable, err := coins.Payable(database.Instance, machine.ID, machine.Currency)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": machine.ID, "total": box.Total(), "exact_change_only": coins.ExactChangeOnly(machine.Currency, payable)})
+}
@@ -2,27 +2,33 @@ package controllers
 
 import (
 	"errors"
-	"math"
 	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
 	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/ledger"
 	"mvpmatch/veding-machine/models"
+	"mvpmatch/veding-machine/promotions"
+	"mvpmatch/veding-machine/reservations"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-const (
-	FIVE = iota
-	TEN
-	TWENTY
-	FIFTY
-	HUNDRED
+var (
+	errNotStocked     = errors.New("product not stocked in this machine")
+	errNotEnoughMoney = errors.New("not enough money")
+	errReserved       = errors.New("products are reserved by another buyer")
 )
 
 type BuyRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
 	ProductId uuid.UUID `json:"product_id"`
+	Slot      string    `json:"slot"`
 	Amount    int       `json:"amount" binding:"gte=1,lte=100"`
 }
 
@@ -56,102 +62,211 @@ func Buy(context *gin.Context) {
 		return
 	}
 
-	product := models.Product{}
-	record = database.Instance.Where("id = ? ", buy.ProductId).First(&product)
+	machine := models.Machine{}
+	record = database.Instance.Where("id = ? ", buy.MachineID).First(&machine)
 	if record.Error != nil {
-		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "machine not found"})
+		return
+	}
+
+	if machine.Status != models.MachineActive {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "machine not active"})
 		return
 	}
 
-	balance := models.Balance{}
-	record = database.Instance.Where("user_id = ? ", claims.UserID).First(&balance)
+	slot := models.Slot{}
+	if buy.Slot != "" {
+		record = database.Instance.Where("machine_id = ? AND code = ? ", buy.MachineID, buy.Slot).First(&slot)
+		if record.Error != nil {
+			context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "slot not found"})
+			return
+		}
+		if buy.ProductId != uuid.Nil && buy.ProductId != slot.ProductID {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "product is not in this slot"})
+			return
+		}
+		if buy.Amount > slot.Fill {
+			context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "not enough products in slot"})
+			return
+		}
+		buy.ProductId = slot.ProductID
+	}
+
+	if buy.ProductId == uuid.Nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing product id or slot"})
+		return
+	}
+
+	product := models.Product{}
+	record = database.Instance.Where("id = ? ", buy.ProductId).First(&product)
 	if record.Error != nil {
 		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
 		return
 	}
 
-	summedBalance := sumBalance(balance)
-
-	if product.Price*buy.Amount > summedBalance {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "not enough money"})
-		context.Abort()
+	if product.Currency != machine.Currency {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "product is priced in " + product.Currency + " but the machine takes " + machine.Currency})
 		return
 	}
 
-	if buy.Amount > product.Available {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "not enough products"})
-		context.Abort()
+	if refusal := ageRestriction(user, product, time.Now()); refusal != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, refusal)
 		return
 	}
 
-	cost := product.Price * buy.Amount
+	var (
+		cost     int
+		applied  []promotions.Applied
+		change   coins.Set
+		purchase models.Purchase
+	)
+	err = database.Serializable(func(tx *gorm.DB) error {
+		// lock everything the purchase reads before changing it, always in
+		// the same order: product, inventory, balance, cash box
+		locked := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Session(&gorm.Session{})
 
-	balanceToReturn := calculateChange(cost, balance)
+		record := locked.Where("id = ?", buy.ProductId).First(&product)
+		if record.Error != nil {
+			return record.Error
+		}
 
-	product.Available -= buy.Amount
+		inventory := models.Inventory{}
+		record = locked.Where("machine_id = ? AND product_id = ?", buy.MachineID, buy.ProductId).First(&inventory)
+		if errors.Is(record.Error, gorm.ErrRecordNotFound) {
+			return errNotStocked
+		}
+		if record.Error != nil {
+			return record.Error
+		}
 
-	record = database.Instance.Where("id = ? ", buy.ProductId).Save(&product)
-	if record.Error != nil {
-		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		balance, err := coins.Balance(locked, claims.UserID, machine.Currency)
+		if err != nil {
+			return err
+		}
+		depositedAt, err := coins.DepositedAt(tx, claims.UserID, machine.Currency)
+		if err != nil {
+			return err
+		}
+		if depositedAt != uuid.Nil && depositedAt != machine.ID {
+			return errOtherMachine
+		}
+
+		now := time.Now()
+		rules, err := promotions.ForProduct(product, now)
+		if err != nil {
+			return err
+		}
+		cost, applied = promotions.Price(product, buy.Amount, rules, now, coins.Smallest(machine.Currency))
+
+		if cost > balance.Total() {
+			return errNotEnoughMoney
+		}
+		if buy.Amount > inventory.Available {
+			return errNotEnoughStock
+		}
+
+		// units other buyers have reserved are not for sale, the buyer's own
+		// reservation is used by this purchase
+		held, err := reservations.Held(tx, buy.MachineID, buy.ProductId, claims.UserID)
+		if err != nil {
+			return err
+		}
+		if buy.Amount > inventory.Available-held {
+			return errReserved
+		}
+
+		box, err := coins.Spendable(tx, machine.ID, machine.Currency, claims.UserID)
+		if err != nil {
+			return err
+		}
+		change, err = coins.Change(machine.Currency, balance.Total()-cost, box)
+		if err != nil {
+			return err
+		}
+
+		movement := models.StockMovement{
+			MachineID: buy.MachineID,
+			ProductID: buy.ProductId,
+			Slot:      buy.Slot,
+			Kind:      models.MovementSale,
+			Quantity:  -buy.Amount,
+			Reason:    models.ReasonSale,
+			ActorID:   claims.UserID,
+		}
+		purchase = models.Purchase{
+			ID:        uuid.New(),
+			BuyerID:   claims.UserID,
+			SellerID:  product.SellerID,
+			MachineID: buy.MachineID,
+			ProductID: buy.ProductId,
+			Quantity:  buy.Amount,
+			UnitPrice: product.Price,
+			Total:     cost,
+			Currency:  machine.Currency,
+		}
+		if err := moveStock(tx, &movement); err != nil {
+			return err
+		}
+		if err := tx.Create(&purchase).Error; err != nil {
+			return err
+		}
+		if err := coins.Dispense(tx, machine.ID, machine.Currency, change); err != nil {
+			return err
+		}
+		if err := ledger.Purchase(tx, purchase, change.Total()); err != nil {
+			return err
+		}
+		if err := reservations.Use(tx, claims.UserID, buy.MachineID, buy.ProductId, buy.Amount, purchase.ID); err != nil {
+			return err
+		}
+		// the change is handed back, what remains in the balance is nothing
+		return coins.Empty(tx, claims.UserID, machine.Currency)
+	})
+	if errors.Is(err, coins.ErrCannotMakeChange) || errors.Is(err, coins.ErrCashBoxShort) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "the machine cannot give change, insert the exact amount", "code": "exact_change_required", "price": cost})
 		return
 	}
-	record = database.Instance.Where("user_id = ? ", claims.UserID).Save(&balanceToReturn)
-	if record.Error != nil {
-		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+	if err != nil {
+		context.AbortWithStatusJSON(buyErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
+	evaluateStockAlerts(buy.MachineID, buy.ProductId)
+	coins.Changed(claims.UserID)
 
-	balanceArray := []int{}
+	context.JSON(http.StatusOK, gin.H{
+		"purchase_id":     purchase.ID,
+		"currency":        machine.Currency,
+		"spent":           cost,
+		"spent_formatted": coins.Format(machine.Currency, cost),
+		"change":          change.List(),
+		"promotions":      applied,
+	})
+}
 
-	for i := 0; i < balanceToReturn.HUNDRED; i++ {
-		balanceArray = append(balanceArray, 100)
-	}
-	for i := 0; i < balanceToReturn.FIFTY; i++ {
-		balanceArray = append(balanceArray, 50)
-	}
-	for i := 0; i < balanceToReturn.TWENTY; i++ {
-		balanceArray = append(balanceArray, 20)
+// ageRestriction returns why a buyer may not buy an age restricted product,
+// or nil when they may.
+func ageRestriction(user models.User, product models.Product, at time.Time) gin.H {
+	if product.MinimumAge == 0 {
+		return nil
 	}
-	for i := 0; i < balanceToReturn.TEN; i++ {
-		balanceArray = append(balanceArray, 10)
+	age, verified := user.VerifiedAge(at)
+	if !verified {
+		return gin.H{"error": "product is age restricted and your age is not verified", "code": "age_verification_required"}
 	}
-	for i := 0; i < balanceToReturn.FIVE; i++ {
-		balanceArray = append(balanceArray, 5)
+	if age < product.MinimumAge {
+		return gin.H{"error": "you are not old enough to buy this product", "code": "age_restricted"}
 	}
-
-	context.JSON(http.StatusOK, gin.H{"spent": cost, "change": balanceArray})
-}
-
-func sumBalance(b models.Balance) int {
-	sum := b.FIVE*5 + b.TEN*10 + b.TWENTY*20 + b.FIFTY*50 + b.HUNDRED*100
-	return sum
+	return nil
 }
 
-func calculateChange(cost int, b models.Balance) (fb models.Balance) {
-	sum := sumBalance(b)
-	change := sum - cost
-
-	for i := 4; i >= 0; i-- {
-		if change == 0 {
-			return
-		}
-		switch i {
-		case HUNDRED:
-			fb.HUNDRED = int(math.Floor(float64(change) / 100))
-			change -= fb.HUNDRED * 100
-		case FIFTY:
-			fb.FIFTY = int(math.Floor(float64(change) / 50))
-			change -= fb.FIFTY * 50
-		case TWENTY:
-			fb.TWENTY = int(math.Floor(float64(change) / 20))
-			change -= fb.TWENTY * 20
-		case TEN:
-			fb.TEN = int(math.Floor(float64(change) / 10))
-			change -= fb.TEN * 10
-		case FIVE:
-			fb.FIVE = int(math.Floor(float64(change) / 5))
-			change -= fb.FIVE * 5
-		}
-	}
-	return
+func buyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotStocked):
+		return http.StatusNotFound
+	case errors.Is(err, errNotEnoughMoney):
+		return http.StatusInternalServerError
+	case errors.Is(err, errReserved), errors.Is(err, errOtherMachine):
+		return http.StatusConflict
+	}
+	return stockErrorStatus(err)
 }
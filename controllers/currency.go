@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type CurrencyRequest struct {
+	Code          string `json:"code" binding:"required,iso4217"`
+	MinorUnits    int    `json:"minor_units" binding:"min=0,max=4"`
+	Denominations []int  `json:"denominations" binding:"required,min=1,max=20,unique,dive,min=1"`
+}
+
+func GetCurrencies(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"currencies": coins.Currencies()})
+}
+
+// SetCurrency adds a currency or replaces its minor units and accepted
+// coins. Balances in coins that are no longer accepted are kept so they can
+// still be returned.
+func SetCurrency(context *gin.Context) {
+	var rq CurrencyRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	err := database.Instance.Transaction(func(tx *gorm.DB) error {
+		currency := models.Currency{Code: rq.Code, MinorUnits: rq.MinorUnits}
+		record := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "code"}},
+			DoUpdates: clause.AssignmentColumns([]string{"minor_units"}),
+		}).Create(&currency)
+		if record.Error != nil {
+			return record.Error
+		}
+		record = tx.Where("currency = ?", rq.Code).Delete(&models.Denomination{})
+		if record.Error != nil {
+			return record.Error
+		}
+		for _, value := range rq.Denominations {
+			if err := tx.Create(&models.Denomination{Currency: rq.Code, Value: value}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := coins.Load(); err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency, _ := coins.Lookup(rq.Code)
+	context.JSON(http.StatusOK, gin.H{"currency": currency})
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errPreconditionRequired = errors.New("missing If-Match header")
+	errPreconditionFailed   = errors.New("product was modified, reload it and retry")
+)
+
+// productETag tags a product version and, for a translated product, the
+// locale it is served in, so caches don't mix up the translations.
+func productETag(product models.Product) string {
+	if product.Locale != "" {
+		return `"` + strconv.Itoa(product.Version) + "-" + product.Locale + `"`
+	}
+	return `"` + strconv.Itoa(product.Version) + `"`
+}
+
+// ifMatchVersion reads the product version a client expects from the
+// If-Match header, ignoring the locale of a translated product's tag. A "*"
+// matches any version and is returned as 0.
+func ifMatchVersion(context *gin.Context) (int, error) {
+	header := strings.TrimSpace(context.GetHeader("If-Match"))
+	if header == "" {
+		return 0, errPreconditionRequired
+	}
+	if header == "*" {
+		return 0, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	tag, _, _ = strings.Cut(tag, "-")
+	version, err := strconv.Atoi(tag)
+	if err != nil || version < 1 {
+		return 0, errPreconditionFailed
+	}
+	return version, nil
+}
+
+func preconditionStatus(err error) int {
+	if errors.Is(err, errPreconditionRequired) {
+		return http.StatusPreconditionRequired
+	}
+	return http.StatusPreconditionFailed
+}
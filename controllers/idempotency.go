@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"mvpmatch/veding-machine/idempotency"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// GetStuckIdempotencyKeys lists the idempotency keys whose request may have
+// gone through without its response being stored.
+func GetStuckIdempotencyKeys(context *gin.Context) {
+	stuck, err := idempotency.Stuck()
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"keys": stuck})
+}
+
+// ReleaseIdempotencyKey frees a stuck key once an admin checked that its
+// request didn't go through, so the client can retry with it.
+func ReleaseIdempotencyKey(context *gin.Context) {
+	userID, err := uuid.Parse(context.Param("user"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	released, err := idempotency.Release(userID, context.Param("key"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !released {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "idempotency key is not stuck"})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"user_id": userID, "key": context.Param("key")})
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func CreateMachine(context *gin.Context) {
+	token := auth.GetToken(context)
+	machine := models.Machine{}
+	if err := context.ShouldBindJSON(&machine); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine.ID = uuid.New()
+	machine.OperatorID = claims.UserID
+	machine.Currency = coins.OrDefault(machine.Currency)
+	if !coins.Known(machine.Currency) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "currency " + machine.Currency + " not accepted"})
+		return
+	}
+
+	record := database.Instance.Create(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": machine.ID})
+}
+
+func UpdateMachine(context *gin.Context) {
+	token := auth.GetToken(context)
+	machine := models.Machine{}
+	if err := context.ShouldBindJSON(&machine); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if machine.ID == uuid.Nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing machine id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := database.Instance.Model(&models.Machine{}).Where("id = ? AND operator_id = ?", machine.ID, claims.UserID).Updates(map[string]interface{}{
+		"serial":   machine.Serial,
+		"location": machine.Location,
+		"status":   machine.Status,
+	})
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if record.RowsAffected == 0 {
+		context.JSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this machine"})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": machine.ID})
+}
+
+func GetMachines(context *gin.Context) {
+	machines := []models.Machine{}
+	record := database.Instance.Find(&machines)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machines": machines})
+}
+
+type InventoryRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	ProductID uuid.UUID `json:"product_id" binding:"required"`
+	Available int       `json:"available" binding:"min=0,max=99"`
+}
+
+func SetInventory(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq InventoryRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ?", rq.MachineID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "machine not found"})
+		return
+	}
+	if machine.OperatorID != claims.UserID {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to stock this machine"})
+		return
+	}
+
+	product := models.Product{}
+	record = database.Instance.Where("id = ? AND seller_id = ?", rq.ProductID, claims.UserID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to stock this product"})
+		return
+	}
+
+	var slots int64
+	record = database.Instance.Model(&models.Slot{}).Where("machine_id = ? AND product_id = ?", rq.MachineID, rq.ProductID).Count(&slots)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if slots > 0 {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "stock of this product is managed by machine slots"})
+		return
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		inventory := models.Inventory{}
+		record := tx.Where("machine_id = ? AND product_id = ?", rq.MachineID, rq.ProductID).Limit(1).Find(&inventory)
+		if record.Error != nil {
+			return record.Error
+		}
+		if rq.Available == inventory.Available {
+			return nil
+		}
+		return moveStock(tx, &models.StockMovement{
+			MachineID: rq.MachineID,
+			ProductID: rq.ProductID,
+			Kind:      models.MovementAdjustment,
+			Quantity:  rq.Available - inventory.Available,
+			Reason:    models.ReasonCountCorrection,
+			ActorID:   claims.UserID,
+		})
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(stockErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": rq.MachineID, "product_id": rq.ProductID, "available": rq.Available})
+}
@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// slot codes are a row letter followed by a column number, e.g. A1 or C12
+var slotCodePattern = regexp.MustCompile(`^([A-Z])([1-9][0-9]?)$`)
+
+type SlotRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	Code      string    `json:"code" binding:"required"`
+	ProductID uuid.UUID `json:"product_id" binding:"required"`
+	Capacity  int       `json:"capacity" binding:"min=1,max=99"`
+	Fill      int       `json:"fill" binding:"min=0,ltefield=Capacity"`
+}
+
+type DeleteSlotRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	Code      string    `json:"code" binding:"required"`
+}
+
+type PlanogramSlot struct {
+	Code        string    `json:"code"`
+	Column      int       `json:"column"`
+	ProductID   uuid.UUID `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	Price       int       `json:"price"`
+	Capacity    int       `json:"capacity"`
+	Fill        int       `json:"fill"`
+}
+
+type PlanogramRow struct {
+	Row   string          `json:"row"`
+	Slots []PlanogramSlot `json:"slots"`
+}
+
+func SetSlot(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq SlotRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !slotCodePattern.MatchString(rq.Code) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid slot code"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ? AND operator_id = ?", rq.MachineID, claims.UserID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this machine"})
+		return
+	}
+
+	product := models.Product{}
+	record = database.Instance.Where("id = ?", rq.ProductID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		previous := models.Slot{}
+		record := tx.Where("machine_id = ? AND code = ?", rq.MachineID, rq.Code).Limit(1).Find(&previous)
+		if record.Error != nil {
+			return record.Error
+		}
+
+		if err := removeUnslottedStock(tx, rq.MachineID, rq.ProductID, claims.UserID); err != nil {
+			return err
+		}
+
+		slot := models.Slot{
+			MachineID: rq.MachineID,
+			Code:      rq.Code,
+			ProductID: rq.ProductID,
+			Capacity:  rq.Capacity,
+			Fill:      rq.Fill,
+		}
+		record = tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "machine_id"}, {Name: "code"}},
+			DoUpdates: clause.AssignmentColumns([]string{"product_id", "capacity", "fill", "updated_at"}),
+		}).Create(&slot)
+		if record.Error != nil {
+			return record.Error
+		}
+
+		if err := syncInventoryFromSlots(tx, rq.MachineID, rq.ProductID); err != nil {
+			return err
+		}
+		if previous.ProductID != uuid.Nil && previous.ProductID != rq.ProductID {
+			if err := syncInventoryFromSlots(tx, rq.MachineID, previous.ProductID); err != nil {
+				return err
+			}
+			if err := recordPlanogramMovement(tx, previous, -previous.Fill, claims.UserID); err != nil {
+				return err
+			}
+			previous.Fill = 0
+		}
+		return recordPlanogramMovement(tx, slot, slot.Fill-previous.Fill, claims.UserID)
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": rq.MachineID, "code": rq.Code, "product_id": rq.ProductID})
+}
+
+func DeleteSlot(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq DeleteSlotRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ? AND operator_id = ?", rq.MachineID, claims.UserID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this machine"})
+		return
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		slot := models.Slot{}
+		record := tx.Where("machine_id = ? AND code = ?", rq.MachineID, rq.Code).First(&slot)
+		if record.Error != nil {
+			return record.Error
+		}
+		record = tx.Unscoped().Delete(&slot)
+		if record.Error != nil {
+			return record.Error
+		}
+		if err := syncInventoryFromSlots(tx, rq.MachineID, slot.ProductID); err != nil {
+			return err
+		}
+		return recordPlanogramMovement(tx, slot, -slot.Fill, claims.UserID)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "slot not found"})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": rq.MachineID, "code": rq.Code})
+}
+
+func GetPlanogram(context *gin.Context) {
+	machineID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid machine id"})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ?", machineID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "machine not found"})
+		return
+	}
+
+	slots := []models.Slot{}
+	record = database.Instance.Where("machine_id = ?", machineID).Find(&slots)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+
+	productIDs := []uuid.UUID{}
+	for _, slot := range slots {
+		productIDs = append(productIDs, slot.ProductID)
+	}
+	products := []models.Product{}
+	record = database.Instance.Where("id IN ?", productIDs).Find(&products)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	productsByID := map[uuid.UUID]models.Product{}
+	for _, product := range products {
+		productsByID[product.ID] = product
+	}
+
+	rowsByName := map[string]*PlanogramRow{}
+	for _, slot := range slots {
+		match := slotCodePattern.FindStringSubmatch(slot.Code)
+		if match == nil {
+			continue
+		}
+		column, _ := strconv.Atoi(match[2])
+		row, ok := rowsByName[match[1]]
+		if !ok {
+			row = &PlanogramRow{Row: match[1]}
+			rowsByName[match[1]] = row
+		}
+		product := productsByID[slot.ProductID]
+		row.Slots = append(row.Slots, PlanogramSlot{
+			Code:        slot.Code,
+			Column:      column,
+			ProductID:   slot.ProductID,
+			ProductName: product.Name,
+			Price:       product.Price,
+			Capacity:    slot.Capacity,
+			Fill:        slot.Fill,
+		})
+	}
+
+	grid := []PlanogramRow{}
+	for _, row := range rowsByName {
+		sort.Slice(row.Slots, func(i, j int) bool { return row.Slots[i].Column < row.Slots[j].Column })
+		grid = append(grid, *row)
+	}
+	sort.Slice(grid, func(i, j int) bool { return grid[i].Row < grid[j].Row })
+
+	context.JSON(http.StatusOK, gin.H{"machine_id": machineID, "rows": grid})
+}
+
+// syncInventoryFromSlots sets the machine inventory of a product to the
+// combined fill of all slots that hold it.
+func syncInventoryFromSlots(tx *gorm.DB, machineID uuid.UUID, productID uuid.UUID) error {
+	var fill int
+	record := tx.Model(&models.Slot{}).Select("COALESCE(SUM(fill), 0)").Where("machine_id = ? AND product_id = ?", machineID, productID).Scan(&fill)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	inventory := models.Inventory{MachineID: machineID, ProductID: productID, Available: fill}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "machine_id"}, {Name: "product_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"available", "updated_at"}),
+	}).Create(&inventory).Error
+}
+
+// removeUnslottedStock takes stock of a product that is kept outside of
+// slots off the books before its first slot is set up, as from then on the
+// inventory is the combined fill of its slots.
+func removeUnslottedStock(tx *gorm.DB, machineID uuid.UUID, productID uuid.UUID, actorID uuid.UUID) error {
+	var slots int64
+	record := tx.Model(&models.Slot{}).Where("machine_id = ? AND product_id = ?", machineID, productID).Count(&slots)
+	if record.Error != nil || slots > 0 {
+		return record.Error
+	}
+
+	inventory := models.Inventory{}
+	record = tx.Where("machine_id = ? AND product_id = ?", machineID, productID).Limit(1).Find(&inventory)
+	if record.Error != nil {
+		return record.Error
+	}
+	return recordPlanogramMovement(tx, models.Slot{MachineID: machineID, ProductID: productID}, -inventory.Available, actorID)
+}
+
+// recordPlanogramMovement writes the ledger entry for a slot fill that was
+// set directly through the planogram.
+func recordPlanogramMovement(tx *gorm.DB, slot models.Slot, quantity int, actorID uuid.UUID) error {
+	if quantity == 0 {
+		return nil
+	}
+	movement := models.StockMovement{
+		MachineID: slot.MachineID,
+		ProductID: slot.ProductID,
+		Slot:      slot.Code,
+		Kind:      models.MovementAdjustment,
+		Quantity:  quantity,
+		Reason:    models.ReasonPlanogram,
+		ActorID:   actorID,
+	}
+	if _, err := applyBatches(tx, &movement); err != nil {
+		return err
+	}
+	return tx.Create(&movement).Error
+}
+
+// drainSlots removes amount units of a product from the machine's slots,
+// emptying them in slot code order.
+func drainSlots(tx *gorm.DB, machineID uuid.UUID, productID uuid.UUID, amount int) error {
+	slots := []models.Slot{}
+	record := tx.Where("machine_id = ? AND product_id = ? AND fill > 0", machineID, productID).Order("code").Find(&slots)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	for _, slot := range slots {
+		if amount == 0 {
+			return nil
+		}
+		taken := slot.Fill
+		if taken > amount {
+			taken = amount
+		}
+		record = tx.Model(&slot).Update("fill", slot.Fill-taken)
+		if record.Error != nil {
+			return record.Error
+		}
+		amount -= taken
+	}
+	return nil
+}
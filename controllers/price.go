@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+type SchedulePriceRequest struct {
+	Price         int       `json:"price" binding:"min=0"`
+	EffectiveFrom time.Time `json:"effective_from" binding:"required"`
+}
+
+func GetProductPrices(context *gin.Context) {
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	// scheduled prices are only shown to the seller before they take effect
+	query := database.Instance.Where("product_id = ?", productID)
+	if !isProductSeller(auth.GetToken(context), productID) {
+		query = query.Where("applied = ?", true)
+	}
+
+	prices := []models.ProductPrice{}
+	record := query.Order("effective_from").Find(&prices)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product_id": productID, "prices": prices})
+}
+
+// isProductSeller reports whether token is a valid access token of the
+// seller of a product. The token is optional on public routes.
+func isProductSeller(token string, productID uuid.UUID) bool {
+	if token == "" || auth.ValidateAccessToken(token) != nil {
+		return false
+	}
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		return false
+	}
+	var count int64
+	record := database.Instance.Model(&models.Product{}).Where("id = ? AND seller_id = ?", productID, claims.UserID).Count(&count)
+	return record.Error == nil && count > 0
+}
+
+func SchedulePrice(context *gin.Context) {
+	token := auth.GetToken(context)
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	var rq SchedulePriceRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	if !rq.EffectiveFrom.After(time.Now()) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "effective_from must be in the future"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	product := models.Product{}
+	record := database.Instance.Where("id = ? AND seller_id = ?", productID, claims.UserID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this product"})
+		return
+	}
+
+	if err := checkPrice(rq.Price, product.Currency); err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry := models.ProductPrice{
+		ProductID:     productID,
+		Price:         rq.Price,
+		EffectiveFrom: rq.EffectiveFrom,
+	}
+	record = database.Instance.Create(&entry)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"price": entry})
+}
@@ -1,21 +1,38 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
 	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
 	"mvpmatch/veding-machine/database"
 	"mvpmatch/veding-machine/models"
+	"mvpmatch/veding-machine/pricing"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+var (
+	errCurrencyStocked = errors.New("product is stocked in machines that take its current currency, take it out before changing the currency")
+	errStockInProduct  = errors.New("available is not a product field anymore, stock is kept per machine: use /secured/restock or /secured/inventory")
 )
 
 func CreateProduct(context *gin.Context) {
 	token := auth.GetToken(context)
+	if stockInRequest(context) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errStockInProduct.Error()})
+		return
+	}
 	product := models.Product{}
-	if err := context.ShouldBindJSON(&product); err != nil {
+	if err := context.ShouldBindBodyWith(&product, binding.JSON); err != nil {
 		var ve validator.ValidationErrors
 		if errors.As(err, &ve) {
 			out := make([]ErrorMsg, len(ve))
@@ -29,8 +46,9 @@ func CreateProduct(context *gin.Context) {
 		return
 	}
 
-	if product.Price%5 != 0 {
-		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "price not divisible by 5 or 10"})
+	product.Currency = coins.OrDefault(product.Currency)
+	if err := checkPrice(product.Price, product.Currency); err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -44,21 +62,61 @@ func CreateProduct(context *gin.Context) {
 	}
 
 	product.SellerID = claims.UserID
+	product.Version = 1
 
-	record := database.Instance.Create(&product)
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		record := tx.Create(&product)
+		if record.Error != nil {
+			return record.Error
+		}
+		return pricing.RecordPrice(tx, product.ID, product.Price)
+	})
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		context.Abort()
+		return
+	}
+	context.Header("ETag", productETag(product))
+	context.JSON(http.StatusOK, gin.H{"product_id": product.ID, "version": product.Version})
+}
 
+func GetProduct(context *gin.Context) {
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	product := models.Product{}
+	record := database.Instance.Where("id = ?", productID).First(&product)
 	if record.Error != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
-		context.Abort()
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not found"})
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"product_id": product.ID})
+
+	if err := localizeProducts(context, 1, func(int) *models.Product { return &product }); err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	etag := productETag(product)
+	context.Header("ETag", etag)
+	context.Header("Vary", "Accept-Language")
+	if context.GetHeader("If-None-Match") == etag {
+		context.Status(http.StatusNotModified)
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product": product})
 }
 
 func UpdateProduct(context *gin.Context) {
 	token := auth.GetToken(context)
+	if stockInRequest(context) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errStockInProduct.Error()})
+		return
+	}
 	product := models.Product{}
-	if err := context.ShouldBindJSON(&product); err != nil {
+	if err := context.ShouldBindBodyWith(&product, binding.JSON); err != nil {
 		var ve validator.ValidationErrors
 		if errors.As(err, &ve) {
 			out := make([]ErrorMsg, len(ve))
@@ -78,6 +136,12 @@ func UpdateProduct(context *gin.Context) {
 		return
 	}
 
+	version, err := ifMatchVersion(context)
+	if err != nil {
+		context.AbortWithStatusJSON(preconditionStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	claims, err := auth.GetClaimsFromToken(token)
 	if err != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -86,18 +150,100 @@ func UpdateProduct(context *gin.Context) {
 	}
 
 	product.SellerID = claims.UserID
+	stored := models.Product{}
+	record := database.Instance.Where("id = ? AND seller_id = ?", product.ID, product.SellerID).First(&stored)
+	if record.Error != nil {
+		context.JSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this product"})
+		return
+	}
+	// the currency is kept unless it is changed explicitly
+	if product.Currency == "" {
+		product.Currency = stored.Currency
+	}
+	if err := checkPrice(product.Price, product.Currency); err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	record := database.Instance.Where("id = ? AND seller_id = ?", product.ID, product.SellerID).Update("available", product.Available).Update("price", product.Price).Update("name", product.Name)
-	if record.RowsAffected == 0 {
+	if product.Allergens == nil {
+		product.Allergens = pq.StringArray{}
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		current := models.Product{}
+		record := tx.Where("id = ? AND seller_id = ?", product.ID, product.SellerID).First(&current)
+		if record.Error != nil {
+			return record.Error
+		}
+		if version == 0 {
+			version = current.Version
+		}
+		if product.Currency != current.Currency {
+			var stocked int64
+			record = tx.Model(&models.Inventory{}).
+				Joins("JOIN machines ON machines.id = inventories.machine_id AND machines.deleted_at IS NULL").
+				Where("inventories.product_id = ? AND inventories.available > 0 AND machines.currency = ?", product.ID, current.Currency).
+				Count(&stocked)
+			if record.Error != nil {
+				return record.Error
+			}
+			if stocked > 0 {
+				return errCurrencyStocked
+			}
+		}
+
+		record = tx.Model(&models.Product{}).Where("id = ? AND version = ?", product.ID, version).Updates(map[string]interface{}{
+			"name":        product.Name,
+			"category":    product.Category,
+			"price":       product.Price,
+			"currency":    product.Currency,
+			"minimum_age": product.MinimumAge,
+			"allergens":   product.Allergens,
+			"description": product.Description,
+			"ingredients": product.Ingredients,
+
+			"nutrition_serving_size":  product.Nutrition.ServingSize,
+			"nutrition_energy_kcal":   product.Nutrition.EnergyKcal,
+			"nutrition_fat":           product.Nutrition.Fat,
+			"nutrition_saturated_fat": product.Nutrition.SaturatedFat,
+			"nutrition_carbohydrates": product.Nutrition.Carbohydrates,
+			"nutrition_sugars":        product.Nutrition.Sugars,
+			"nutrition_protein":       product.Nutrition.Protein,
+			"nutrition_salt":          product.Nutrition.Salt,
+			"version":                 gorm.Expr("version + 1"),
+		})
+		if record.Error != nil {
+			return record.Error
+		}
+		if record.RowsAffected == 0 {
+			return errPreconditionFailed
+		}
+		product.Version = version + 1
+
+		if current.Price == product.Price {
+			return nil
+		}
+		return pricing.RecordPrice(tx, product.ID, product.Price)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
 		context.JSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this product"})
 		return
 	}
-	if record.Error != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+	if errors.Is(err, errPreconditionFailed) {
+		context.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errCurrencyStocked) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		context.Abort()
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"product_id": product.ID})
+	context.Header("ETag", productETag(product))
+	context.JSON(http.StatusOK, gin.H{"product_id": product.ID, "version": product.Version})
 }
 
 type DeleteProductRequest struct {
@@ -114,31 +260,139 @@ func DeleteProduct(context *gin.Context) {
 		return
 	}
 
+	version, err := ifMatchVersion(context)
+	if err != nil {
+		context.AbortWithStatusJSON(preconditionStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
 	claims, err := auth.GetClaimsFromToken(token)
 	if err != nil {
 		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	record := database.Instance.Where("id = ? AND seller_id = ?", rq.ID, claims.UserID).Delete(&models.Product{})
-	if record.RowsAffected == 0 {
+	current := models.Product{}
+	record := database.Instance.Where("id = ? AND seller_id = ?", rq.ID, claims.UserID).First(&current)
+	if record.Error != nil {
 		context.JSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to delete this product"})
 		return
 	}
+	if version == 0 {
+		version = current.Version
+	}
+
+	record = database.Instance.Where("id = ? AND seller_id = ? AND version = ?", rq.ID, claims.UserID, version).Delete(&models.Product{})
 	if record.Error != nil {
 		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
 		return
 	}
+	if record.RowsAffected == 0 {
+		context.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": errPreconditionFailed.Error()})
+		return
+	}
 
 	context.JSON(http.StatusOK, gin.H{"product_id": rq.ID})
 }
 
+type MachineProduct struct {
+	models.Product
+	Available int `json:"available"`
+}
+
 func GetProducts(context *gin.Context) {
-	products := []models.Product{}
-	record := database.Instance.Find(&products)
+	excluded, err := excludedAllergens(context)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := database.Instance.Model(&models.Product{})
+	if len(excluded) > 0 {
+		query = query.Where("NOT (products.allergens && ?)", excluded)
+	}
+
+	machineParam := context.Query("machine_id")
+	if machineParam == "" {
+		products := []models.Product{}
+		record := query.Find(&products)
+		if record.Error != nil {
+			context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+			return
+		}
+		if err := localizeProducts(context, len(products), func(i int) *models.Product { return &products[i] }); err != nil {
+			context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		context.JSON(http.StatusOK, gin.H{"products": products})
+		return
+	}
+
+	machineID, err := uuid.Parse(machineParam)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid machine id"})
+		return
+	}
+
+	products := []MachineProduct{}
+	record := query.
+		Select("products.*, inventories.available - COALESCE((SELECT SUM(reservations.quantity) FROM reservations WHERE reservations.machine_id = inventories.machine_id AND reservations.product_id = inventories.product_id AND reservations.released_at IS NULL AND reservations.expires_at > ?), 0) AS available", time.Now()).
+		Joins("JOIN inventories ON inventories.product_id = products.id AND inventories.deleted_at IS NULL").
+		Where("inventories.machine_id = ?", machineID).
+		Scan(&products)
 	if record.Error != nil {
 		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"products": products})
+	if err := localizeProducts(context, len(products), func(i int) *models.Product { return &products[i].Product }); err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": machineID, "products": products})
+}
+
+// stockInRequest reports whether a product request still sets available,
+// the stock products had before it was kept per machine.
+func stockInRequest(context *gin.Context) bool {
+	fields := map[string]json.RawMessage{}
+	if err := context.ShouldBindBodyWith(&fields, binding.JSON); err != nil {
+		return false
+	}
+	_, ok := fields["available"]
+	return ok
+}
+
+// checkPrice makes sure a price is in an accepted currency and can be paid
+// with its coins.
+func checkPrice(price int, currency string) error {
+	if !coins.Known(currency) {
+		return errors.New("currency " + currency + " not accepted")
+	}
+	if price%coins.Smallest(currency) != 0 {
+		return errors.New("price not divisible by the smallest coin")
+	}
+	return nil
+}
+
+// excludedAllergens parses the comma separated exclude_allergens query
+// parameter.
+func excludedAllergens(context *gin.Context) (pq.StringArray, error) {
+	value := context.Query("exclude_allergens")
+	if value == "" {
+		return nil, nil
+	}
+
+	known := map[string]bool{}
+	for _, allergen := range models.EUAllergens {
+		known[allergen] = true
+	}
+	excluded := pq.StringArray{}
+	for _, allergen := range strings.Split(value, ",") {
+		allergen = strings.ToLower(strings.TrimSpace(allergen))
+		if !known[allergen] {
+			return nil, errors.New("unknown allergen " + allergen)
+		}
+		excluded = append(excluded, allergen)
+	}
+	return excluded, nil
 }
@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"mvpmatch/veding-machine/pricing"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	formatCSV   = "csv"
+	formatJSONL = "jsonl"
+
+	maxImportSize = 5 << 20
+
+	allergenSeparator = "|"
+)
+
+type ImportRowError struct {
+	Row    int        `json:"row"`
+	Errors []ErrorMsg `json:"errors"`
+}
+
+type ImportedProduct struct {
+	Row       int       `json:"row"`
+	ProductID uuid.UUID `json:"product_id"`
+	Name      string    `json:"name"`
+}
+
+type importRow struct {
+	line    int
+	product models.Product
+	errors  []ErrorMsg
+}
+
+func ImportProducts(context *gin.Context) {
+	token := auth.GetToken(context)
+	dryRun := context.Query("dry_run") == "true"
+	atomic := context.Query("atomic") == "true"
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := http.MaxBytesReader(context.Writer, context.Request.Body, maxImportSize)
+	var rows []importRow
+	switch importFormat(context) {
+	case formatCSV:
+		rows, err = readCSVProducts(body)
+	case formatJSONL:
+		rows, err = readJSONLProducts(body)
+	default:
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported import format"})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateImportRows(rows); err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rowErrors := []ImportRowError{}
+	valid := []importRow{}
+	for _, row := range rows {
+		if len(row.errors) > 0 {
+			rowErrors = append(rowErrors, ImportRowError{row.line, row.errors})
+			continue
+		}
+		row.product.ID = uuid.New()
+		row.product.SellerID = claims.UserID
+		row.product.Version = 1
+		valid = append(valid, row)
+	}
+
+	if dryRun || (atomic && len(rowErrors) > 0) {
+		status := http.StatusOK
+		if len(rowErrors) > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		context.JSON(status, gin.H{"dry_run": dryRun, "valid": len(valid), "imported": 0, "errors": rowErrors})
+		return
+	}
+
+	imported := []ImportedProduct{}
+	if atomic {
+		err = database.Instance.Transaction(func(tx *gorm.DB) error {
+			for _, row := range valid {
+				if err := createImportedProduct(tx, &row.product); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, row := range valid {
+			imported = append(imported, ImportedProduct{row.line, row.product.ID, row.product.Name})
+		}
+	} else {
+		for _, row := range valid {
+			err := database.Instance.Transaction(func(tx *gorm.DB) error {
+				return createImportedProduct(tx, &row.product)
+			})
+			if err != nil {
+				rowErrors = append(rowErrors, ImportRowError{row.line, []ErrorMsg{{"Name", err.Error()}}})
+				continue
+			}
+			imported = append(imported, ImportedProduct{row.line, row.product.ID, row.product.Name})
+		}
+	}
+
+	context.JSON(http.StatusOK, gin.H{"dry_run": false, "valid": len(valid), "imported": len(imported), "products": imported, "errors": rowErrors})
+}
+
+// ExportProducts writes the seller's products in the format ImportProducts
+// reads. The export is lossy: descriptions, ingredients, nutrition facts and
+// translations are left out, and allergens are separated by "|" in csv.
+func ExportProducts(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := importFormat(context)
+	if format != formatCSV && format != formatJSONL {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported export format"})
+		return
+	}
+
+	rows, err := database.Instance.Model(&models.Product{}).Where("seller_id = ?", claims.UserID).Order("name").Rows()
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var write func(product models.Product) error
+	var flush func()
+	if format == formatCSV {
+		context.Header("Content-Type", "text/csv")
+		context.Header("Content-Disposition", `attachment; filename="products.csv"`)
+		writer := csv.NewWriter(context.Writer)
+		writer.Write([]string{"id", "name", "price", "currency", "category", "minimum_age", "allergens"})
+		write = func(product models.Product) error {
+			return writer.Write([]string{
+				product.ID.String(), product.Name, strconv.Itoa(product.Price), product.Currency, product.Category,
+				strconv.Itoa(product.MinimumAge), strings.Join(product.Allergens, allergenSeparator),
+			})
+		}
+		flush = writer.Flush
+	} else {
+		context.Header("Content-Type", "application/x-ndjson")
+		context.Header("Content-Disposition", `attachment; filename="products.jsonl"`)
+		encoder := json.NewEncoder(context.Writer)
+		write = func(product models.Product) error {
+			return encoder.Encode(gin.H{
+				"id": product.ID, "name": product.Name, "price": product.Price, "currency": product.Currency, "category": product.Category,
+				"minimum_age": product.MinimumAge, "allergens": product.Allergens,
+			})
+		}
+		flush = func() {}
+	}
+	context.Status(http.StatusOK)
+
+	for rows.Next() {
+		product := models.Product{}
+		if err := database.Instance.ScanRows(rows, &product); err != nil {
+			return
+		}
+		if err := write(product); err != nil {
+			return
+		}
+		flush()
+		context.Writer.Flush()
+	}
+}
+
+func createImportedProduct(tx *gorm.DB, product *models.Product) error {
+	if err := tx.Create(product).Error; err != nil {
+		return err
+	}
+	return pricing.RecordPrice(tx, product.ID, product.Price)
+}
+
+func importFormat(context *gin.Context) string {
+	if format := context.Query("format"); format != "" {
+		return format
+	}
+	if strings.Contains(context.ContentType(), "csv") {
+		return formatCSV
+	}
+	return formatJSONL
+}
+
+func readCSVProducts(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("missing csv header")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	nameColumn, hasName := columns["name"]
+	priceColumn, hasPrice := columns["price"]
+	categoryColumn, hasCategory := columns["category"]
+	currencyColumn, hasCurrency := columns["currency"]
+	ageColumn, hasAge := columns["minimum_age"]
+	allergensColumn, hasAllergens := columns["allergens"]
+	availableColumn, hasAvailable := columns["available"]
+	if !hasName || !hasPrice {
+		return nil, errors.New("csv header must contain name and price columns")
+	}
+
+	rows := []importRow{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := importRow{line: line}
+		if nameColumn < len(record) {
+			row.product.Name = strings.TrimSpace(record[nameColumn])
+		}
+		if priceColumn < len(record) {
+			price, err := strconv.Atoi(strings.TrimSpace(record[priceColumn]))
+			if err != nil {
+				row.errors = append(row.errors, ErrorMsg{"Price", "price must be a whole number"})
+			}
+			row.product.Price = price
+		}
+		if hasCategory && categoryColumn < len(record) {
+			row.product.Category = strings.TrimSpace(record[categoryColumn])
+		}
+		if hasCurrency && currencyColumn < len(record) {
+			row.product.Currency = strings.TrimSpace(record[currencyColumn])
+		}
+		if hasAge && ageColumn < len(record) && strings.TrimSpace(record[ageColumn]) != "" {
+			age, err := strconv.Atoi(strings.TrimSpace(record[ageColumn]))
+			if err != nil {
+				row.errors = append(row.errors, ErrorMsg{"MinimumAge", "minimum age must be a whole number"})
+			}
+			row.product.MinimumAge = age
+		}
+		if hasAllergens && allergensColumn < len(record) && strings.TrimSpace(record[allergensColumn]) != "" {
+			for _, allergen := range strings.Split(record[allergensColumn], allergenSeparator) {
+				row.product.Allergens = append(row.product.Allergens, strings.TrimSpace(allergen))
+			}
+		}
+		if hasAvailable && availableColumn < len(record) && strings.TrimSpace(record[availableColumn]) != "" {
+			row.errors = append(row.errors, ErrorMsg{"Available", errStockInProduct.Error()})
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONLProducts(body io.Reader) ([]importRow, error) {
+	rows := []importRow{}
+	scanner := bufio.NewScanner(body)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := importRow{line: line}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(text), &fields); err != nil {
+			row.errors = append(row.errors, ErrorMsg{"", err.Error()})
+		} else if _, ok := fields["available"]; ok {
+			row.errors = append(row.errors, ErrorMsg{"Available", errStockInProduct.Error()})
+		} else if err := json.Unmarshal([]byte(text), &row.product); err != nil {
+			row.errors = append(row.errors, ErrorMsg{"", err.Error()})
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// validateImportRows applies the same rules as CreateProduct to every row and
+// checks names for uniqueness against the catalog and the rest of the file.
+func validateImportRows(rows []importRow) error {
+	names := []string{}
+	for _, row := range rows {
+		names = append(names, row.product.Name)
+	}
+	existing := []string{}
+	record := database.Instance.Model(&models.Product{}).Where("name IN ?", names).Pluck("name", &existing)
+	if record.Error != nil {
+		return record.Error
+	}
+	taken := map[string]bool{}
+	for _, name := range existing {
+		taken[name] = true
+	}
+
+	for i := range rows {
+		row := &rows[i]
+		if len(row.errors) > 0 {
+			continue
+		}
+		if err := binding.Validator.ValidateStruct(&row.product); err != nil {
+			var ve validator.ValidationErrors
+			if errors.As(err, &ve) {
+				for _, fe := range ve {
+					row.errors = append(row.errors, ErrorMsg{fe.Field(), getErrorMsg(fe)})
+				}
+			} else {
+				row.errors = append(row.errors, ErrorMsg{"", err.Error()})
+			}
+		}
+		row.product.Currency = coins.OrDefault(row.product.Currency)
+		if err := checkPrice(row.product.Price, row.product.Currency); err != nil {
+			row.errors = append(row.errors, ErrorMsg{"Price", err.Error()})
+		}
+		if taken[row.product.Name] {
+			row.errors = append(row.errors, ErrorMsg{"Name", "name already exists"})
+		}
+		taken[row.product.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+type DeletePromotionRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+func CreatePromotion(context *gin.Context) {
+	token := auth.GetToken(context)
+	promotion := models.Promotion{}
+	if err := context.ShouldBindJSON(&promotion); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	switch promotion.Kind {
+	case models.PromotionPercentage:
+		if promotion.Percent == 0 {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "percent is required"})
+			return
+		}
+	case models.PromotionBuyXPayY:
+		if promotion.BuyQuantity < 2 || promotion.PayQuantity < 1 || promotion.PayQuantity >= promotion.BuyQuantity {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "pay quantity must be at least 1 and less than buy quantity"})
+			return
+		}
+	}
+
+	if promotion.ValidFrom != nil && promotion.ValidTo != nil && !promotion.ValidTo.After(*promotion.ValidFrom) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "valid_to must be after valid_from"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if promotion.ProductID != uuid.Nil {
+		product := models.Product{}
+		record := database.Instance.Where("id = ? AND seller_id = ?", promotion.ProductID, claims.UserID).First(&product)
+		if record.Error != nil {
+			context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to promote this product"})
+			return
+		}
+	}
+
+	promotion.ID = uuid.New()
+	promotion.SellerID = claims.UserID
+
+	record := database.Instance.Create(&promotion)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"promotion_id": promotion.ID})
+}
+
+func DeletePromotion(context *gin.Context) {
+	token := auth.GetToken(context)
+	rq := DeletePromotionRequest{}
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := database.Instance.Where("id = ? AND seller_id = ?", rq.ID, claims.UserID).Delete(&models.Promotion{})
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if record.RowsAffected == 0 {
+		context.JSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to delete this promotion"})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"promotion_id": rq.ID})
+}
+
+func GetPromotions(context *gin.Context) {
+	now := time.Now()
+	promotions := []models.Promotion{}
+	record := database.Instance.Where("(valid_from IS NULL OR valid_from <= ?) AND (valid_to IS NULL OR valid_to > ?)", now, now).Find(&promotions)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"promotions": promotions})
+}
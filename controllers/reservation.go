@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"mvpmatch/veding-machine/reservations"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ReservationRequest struct {
+	MachineID  uuid.UUID `json:"machine_id" binding:"required"`
+	ProductID  uuid.UUID `json:"product_id" binding:"required"`
+	Quantity   int       `json:"quantity" binding:"gte=1,lte=100"`
+	TTLSeconds int       `json:"ttl_seconds" binding:"min=0"`
+}
+
+func CreateReservation(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq ReservationRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ttl := reservations.TTL
+	if rq.TTLSeconds > 0 {
+		ttl = time.Duration(rq.TTLSeconds) * time.Second
+	}
+	if ttl > reservations.MaxTTL {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "reservation ttl too long"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ?", rq.MachineID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "machine not found"})
+		return
+	}
+	if machine.Status != models.MachineActive {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "machine not active"})
+		return
+	}
+
+	product := models.Product{}
+	record = database.Instance.Where("id = ?", rq.ProductID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not found"})
+		return
+	}
+	user := models.User{}
+	record = database.Instance.Where("id = ?", claims.UserID).First(&user)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	// buyers can't hold what they wouldn't be allowed to buy
+	if refusal := ageRestriction(user, product, time.Now()); refusal != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, refusal)
+		return
+	}
+
+	now := time.Now()
+	reservation := models.Reservation{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		BuyerID:   claims.UserID,
+		MachineID: rq.MachineID,
+		ProductID: rq.ProductID,
+		Quantity:  rq.Quantity,
+		ExpiresAt: now.Add(ttl),
+	}
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		return reservations.Hold(tx, &reservation)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not stocked in this machine"})
+		return
+	}
+	if errors.Is(err, reservations.ErrNotEnoughStock) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"reservation": reservation})
+}
+
+func GetReservations(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	active := []models.Reservation{}
+	record := database.Instance.
+		Where("buyer_id = ? AND released_at IS NULL AND expires_at > ?", claims.UserID, time.Now()).
+		Order("expires_at").
+		Find(&active)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"reservations": active})
+}
+
+func CancelReservation(context *gin.Context) {
+	token := auth.GetToken(context)
+	reservationID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid reservation id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := database.Instance.Model(&models.Reservation{}).
+		Where("id = ? AND buyer_id = ? AND released_at IS NULL", reservationID, claims.UserID).
+		Update("released_at", time.Now())
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if record.RowsAffected == 0 {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "reservation not found"})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"reservation_id": reservationID})
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"errors"
+	"math"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const dashboardDateLayout = "2006-01-02"
+
+type SellerProduct struct {
+	models.Product
+	Available int `json:"available"`
+}
+
+type BestSeller struct {
+	ProductID uuid.UUID `json:"product_id"`
+	Name      string    `json:"name"`
+	Currency  string    `json:"currency"`
+	Units     int       `json:"units"`
+	Revenue   int       `json:"revenue"`
+}
+
+// CurrencyTotal is an amount of money in one currency. Amounts in different
+// currencies are never added up.
+type CurrencyTotal struct {
+	Currency  string `json:"currency"`
+	Amount    int    `json:"amount"`
+	Formatted string `json:"formatted"`
+}
+
+type salesSummary struct {
+	Currency  string
+	Purchases int
+	Units     int
+	Revenue   int
+}
+
+type stockSummary struct {
+	Currency string
+	Units    int
+	Value    int
+}
+
+func GetSellerProducts(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	products := []SellerProduct{}
+	record := database.Instance.Model(&models.Product{}).
+		Select("products.*, COALESCE(SUM(inventories.available), 0) AS available").
+		Joins("LEFT JOIN inventories ON inventories.product_id = products.id AND inventories.deleted_at IS NULL").
+		Where("products.seller_id = ?", claims.UserID).
+		Group("products.id").
+		Order("products.name").
+		Scan(&products)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"products": products})
+}
+
+func GetSellerDashboard(context *gin.Context) {
+	token := auth.GetToken(context)
+	from, to, err := dashboardRange(context)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sales := []salesSummary{}
+	record := database.Instance.Model(&models.Purchase{}).
+		Select("currency, COUNT(*) AS purchases, SUM(quantity) AS units, SUM(total) AS revenue").
+		Where("seller_id = ? AND created_at >= ? AND created_at < ?", claims.UserID, from, to).
+		Group("currency").
+		Order("currency").
+		Scan(&sales)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+
+	bestSellers := []BestSeller{}
+	record = database.Instance.Table("purchases").
+		Select("purchases.product_id, products.name, purchases.currency, SUM(purchases.quantity) AS units, SUM(purchases.total) AS revenue").
+		Joins("LEFT JOIN products ON products.id = purchases.product_id").
+		Where("purchases.seller_id = ? AND purchases.created_at >= ? AND purchases.created_at < ?", claims.UserID, from, to).
+		Group("purchases.product_id, products.name, purchases.currency").
+		Order("units DESC").
+		Limit(5).
+		Scan(&bestSellers)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+
+	stock := []stockSummary{}
+	record = database.Instance.Model(&models.Product{}).
+		Select("products.currency, SUM(inventories.available) AS units, SUM(inventories.available * products.price) AS value").
+		Joins("JOIN inventories ON inventories.product_id = products.id AND inventories.deleted_at IS NULL").
+		Where("products.seller_id = ?", claims.UserID).
+		Group("products.currency").
+		Order("products.currency").
+		Scan(&stock)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+
+	purchases, unitsSold := 0, 0
+	revenue := []CurrencyTotal{}
+	for _, summary := range sales {
+		purchases += summary.Purchases
+		unitsSold += summary.Units
+		revenue = append(revenue, CurrencyTotal{summary.Currency, summary.Revenue, coins.Format(summary.Currency, summary.Revenue)})
+	}
+	stockUnits := 0
+	stockValue := []CurrencyTotal{}
+	for _, summary := range stock {
+		stockUnits += summary.Units
+		stockValue = append(stockValue, CurrencyTotal{summary.Currency, summary.Value, coins.Format(summary.Currency, summary.Value)})
+	}
+
+	// sell-through is the share of units sold out of everything that was
+	// available to sell: what was sold plus what is still in the machines
+	sellThrough := 0.0
+	if unitsSold+stockUnits > 0 {
+		sellThrough = math.Round(float64(unitsSold)/float64(unitsSold+stockUnits)*10000) / 100
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"from":         from,
+		"to":           to,
+		"purchases":    purchases,
+		"units_sold":   unitsSold,
+		"revenue":      revenue,
+		"stock_units":  stockUnits,
+		"stock_value":  stockValue,
+		"sell_through": sellThrough,
+		"best_sellers": bestSellers,
+	})
+}
+
+// dashboardRange reads the from/to query parameters as dates (to is
+// inclusive) or RFC 3339 timestamps, defaulting to the last 30 days.
+func dashboardRange(context *gin.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+
+	if value := context.Query("from"); value != "" {
+		parsed, _, err := parseDashboardTime(value)
+		if err != nil {
+			return from, to, errors.New("invalid from")
+		}
+		from = parsed
+	}
+	if value := context.Query("to"); value != "" {
+		parsed, dateOnly, err := parseDashboardTime(value)
+		if err != nil {
+			return from, to, errors.New("invalid to")
+		}
+		if dateOnly {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+		to = parsed
+	}
+	if !to.After(from) {
+		return from, to, errors.New("to must be after from")
+	}
+	return from, to, nil
+}
+
+func parseDashboardTime(value string) (time.Time, bool, error) {
+	if parsed, err := time.ParseInLocation(dashboardDateLayout, value, time.Local); err == nil {
+		return parsed, true, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	return parsed, false, err
+}
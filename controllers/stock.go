@@ -0,0 +1,495 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"mvpmatch/veding-machine/alerts"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	errNotEnoughStock = errors.New("not enough products")
+	errSlotCapacity   = errors.New("slot capacity exceeded")
+	errSlotRequired   = errors.New("product is stocked in slots, slot is required")
+	errSlotNotFound   = errors.New("slot not found")
+)
+
+type RestockRequest struct {
+	MachineID  uuid.UUID `json:"machine_id" binding:"required"`
+	ProductID  uuid.UUID `json:"product_id" binding:"required"`
+	Slot       string    `json:"slot"`
+	Quantity   int       `json:"quantity" binding:"min=1,max=99"`
+	LotNumber  string    `json:"lot_number" binding:"max=30"`
+	BestBefore string    `json:"best_before" binding:"omitempty,datetime=2006-01-02"`
+}
+
+type AdjustStockRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	ProductID uuid.UUID `json:"product_id" binding:"required"`
+	Slot      string    `json:"slot"`
+	Kind      int       `json:"kind" binding:"eq=2|eq=3"`
+	Quantity  int       `json:"quantity" binding:"ne=0,min=-99,max=99"`
+	Reason    string    `json:"reason" binding:"oneof=count_correction expired damaged theft"`
+}
+
+type TransferStockRequest struct {
+	FromMachineID uuid.UUID `json:"from_machine_id" binding:"required"`
+	ToMachineID   uuid.UUID `json:"to_machine_id" binding:"required,nefield=FromMachineID"`
+	ProductID     uuid.UUID `json:"product_id" binding:"required"`
+	FromSlot      string    `json:"from_slot"`
+	ToSlot        string    `json:"to_slot"`
+	Quantity      int       `json:"quantity" binding:"min=1,max=99"`
+}
+
+type StockThresholdRequest struct {
+	MachineID uuid.UUID `json:"machine_id" binding:"required"`
+	ProductID uuid.UUID `json:"product_id" binding:"required"`
+	Threshold int       `json:"threshold" binding:"min=0,max=99"`
+}
+
+type StockDiscrepancy struct {
+	ProductID uuid.UUID `json:"product_id"`
+	Available int       `json:"available"`
+	Ledger    int       `json:"ledger"`
+}
+
+func Restock(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq RestockRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status, err := checkStockPermissions(claims.UserID, rq.ProductID, rq.MachineID); err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	movement := models.StockMovement{
+		MachineID: rq.MachineID,
+		ProductID: rq.ProductID,
+		Slot:      rq.Slot,
+		Kind:      models.MovementRestock,
+		Quantity:  rq.Quantity,
+		Reason:    models.ReasonDelivery,
+		ActorID:   claims.UserID,
+		LotNumber: rq.LotNumber,
+	}
+	if rq.BestBefore != "" {
+		bestBefore, _ := time.ParseInLocation(bestBeforeLayout, rq.BestBefore, time.Local)
+		movement.BestBefore = &bestBefore
+	}
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		return moveStock(tx, &movement)
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(stockErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	evaluateStockAlerts(movement.MachineID, movement.ProductID)
+	context.JSON(http.StatusOK, gin.H{"movement": movement})
+}
+
+func AdjustStock(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq AdjustStockRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	// waste is always stock leaving the machine
+	if rq.Kind == models.MovementWaste && rq.Quantity > 0 {
+		rq.Quantity = -rq.Quantity
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status, err := checkStockPermissions(claims.UserID, rq.ProductID, rq.MachineID); err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	movement := models.StockMovement{
+		MachineID: rq.MachineID,
+		ProductID: rq.ProductID,
+		Slot:      rq.Slot,
+		Kind:      rq.Kind,
+		Quantity:  rq.Quantity,
+		Reason:    rq.Reason,
+		ActorID:   claims.UserID,
+	}
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		return moveStock(tx, &movement)
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(stockErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	evaluateStockAlerts(movement.MachineID, movement.ProductID)
+	context.JSON(http.StatusOK, gin.H{"movement": movement})
+}
+
+func TransferStock(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq TransferStockRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status, err := checkStockPermissions(claims.UserID, rq.ProductID, rq.FromMachineID); err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := checkStockPermissions(claims.UserID, rq.ProductID, rq.ToMachineID); err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	reference := uuid.New()
+	out := models.StockMovement{
+		MachineID: rq.FromMachineID,
+		ProductID: rq.ProductID,
+		Slot:      rq.FromSlot,
+		Kind:      models.MovementTransfer,
+		Quantity:  -rq.Quantity,
+		Reason:    models.ReasonRebalance,
+		ActorID:   claims.UserID,
+		Reference: reference,
+	}
+	movements := []models.StockMovement{}
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		taken, err := applyBatches(tx, &out)
+		if err != nil {
+			return err
+		}
+		if err := applyMovement(tx, &out); err != nil {
+			return err
+		}
+		movements = append(movements, out)
+
+		// the stock arrives as one movement per lot it was taken from, so
+		// that its lot number and best-before date move along with it
+		untracked := rq.Quantity
+		in := models.StockMovement{
+			MachineID: rq.ToMachineID,
+			ProductID: rq.ProductID,
+			Slot:      rq.ToSlot,
+			Kind:      models.MovementTransfer,
+			Reason:    models.ReasonRebalance,
+			ActorID:   claims.UserID,
+			Reference: reference,
+		}
+		for _, batch := range taken {
+			lot := in
+			lot.Quantity = batch.Quantity
+			lot.LotNumber = batch.LotNumber
+			lot.BestBefore = batch.BestBefore
+			if err := moveStock(tx, &lot); err != nil {
+				return err
+			}
+			movements = append(movements, lot)
+			untracked -= batch.Quantity
+		}
+		if untracked > 0 {
+			in.Quantity = untracked
+			if err := moveStock(tx, &in); err != nil {
+				return err
+			}
+			movements = append(movements, in)
+		}
+		return nil
+	})
+	if err != nil {
+		context.AbortWithStatusJSON(stockErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	evaluateStockAlerts(rq.FromMachineID, rq.ProductID)
+	evaluateStockAlerts(rq.ToMachineID, rq.ProductID)
+	context.JSON(http.StatusOK, gin.H{"movements": movements})
+}
+
+func SetStockThreshold(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq StockThresholdRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status, err := checkStockPermissions(claims.UserID, rq.ProductID, rq.MachineID); err != nil {
+		context.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := database.Instance.Model(&models.Inventory{}).Where("machine_id = ? AND product_id = ?", rq.MachineID, rq.ProductID).Update("low_stock_threshold", rq.Threshold)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if record.RowsAffected == 0 {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not stocked in this machine"})
+		return
+	}
+	evaluateStockAlerts(rq.MachineID, rq.ProductID)
+	context.JSON(http.StatusOK, gin.H{"machine_id": rq.MachineID, "product_id": rq.ProductID, "threshold": rq.Threshold})
+}
+
+func GetStockMovements(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := database.Instance.Where(
+		"(product_id IN (?) OR machine_id IN (?))",
+		database.Instance.Model(&models.Product{}).Select("id").Where("seller_id = ?", claims.UserID),
+		database.Instance.Model(&models.Machine{}).Select("id").Where("operator_id = ?", claims.UserID),
+	)
+	if machineID := context.Query("machine_id"); machineID != "" {
+		query = query.Where("machine_id = ?", machineID)
+	}
+	if productID := context.Query("product_id"); productID != "" {
+		query = query.Where("product_id = ?", productID)
+	}
+
+	movements := []models.StockMovement{}
+	record := query.Order("id").Find(&movements)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"movements": movements})
+}
+
+func ReconcileStock(context *gin.Context) {
+	token := auth.GetToken(context)
+	machineID, err := uuid.Parse(context.Query("machine_id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid machine id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ? AND operator_id = ?", machineID, claims.UserID).First(&machine)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to reconcile this machine"})
+		return
+	}
+
+	discrepancies := []StockDiscrepancy{}
+	record = database.Instance.Table("inventories").
+		Select("inventories.product_id, inventories.available, COALESCE(SUM(stock_movements.quantity), 0) AS ledger").
+		Joins("LEFT JOIN stock_movements ON stock_movements.machine_id = inventories.machine_id AND stock_movements.product_id = inventories.product_id").
+		Where("inventories.machine_id = ? AND inventories.deleted_at IS NULL", machineID).
+		Group("inventories.product_id, inventories.available").
+		Having("inventories.available <> COALESCE(SUM(stock_movements.quantity), 0)").
+		Scan(&discrepancies)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"machine_id": machineID, "consistent": len(discrepancies) == 0, "discrepancies": discrepancies})
+}
+
+// evaluateStockAlerts checks the low-stock threshold in the background so
+// that slow alert channels do not hold up the request.
+func evaluateStockAlerts(machineID uuid.UUID, productID uuid.UUID) {
+	go func() {
+		if err := alerts.Evaluate(machineID, productID); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+// checkStockPermissions allows the seller of a product to move its stock
+// in and out of the machines they operate.
+func checkStockPermissions(userID uuid.UUID, productID uuid.UUID, machineID uuid.UUID) (int, error) {
+	machine := models.Machine{}
+	record := database.Instance.Where("id = ?", machineID).First(&machine)
+	if record.Error != nil {
+		return http.StatusNotFound, errors.New("machine not found")
+	}
+	if machine.OperatorID != userID {
+		return http.StatusForbidden, errors.New("you dont have permissions to stock this machine")
+	}
+
+	product := models.Product{}
+	record = database.Instance.Where("id = ? AND seller_id = ?", productID, userID).First(&product)
+	if record.Error != nil {
+		return http.StatusForbidden, errors.New("you dont have permissions to stock this product")
+	}
+	return http.StatusOK, nil
+}
+
+func stockErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotEnoughStock), errors.Is(err, errSlotCapacity), errors.Is(err, errStockExpired):
+		return http.StatusConflict
+	case errors.Is(err, errSlotRequired):
+		return http.StatusBadRequest
+	case errors.Is(err, errSlotNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// moveStock applies a stock movement to the machine inventory (and to its
+// slots when the product is stocked in slots) and appends it to the ledger.
+func moveStock(tx *gorm.DB, movement *models.StockMovement) error {
+	if _, err := applyBatches(tx, movement); err != nil {
+		return err
+	}
+	return applyMovement(tx, movement)
+}
+
+// applyMovement is moveStock without keeping the stock batches in step.
+func applyMovement(tx *gorm.DB, movement *models.StockMovement) error {
+	var slots int64
+	record := tx.Model(&models.Slot{}).Where("machine_id = ? AND product_id = ?", movement.MachineID, movement.ProductID).Count(&slots)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	if slots > 0 {
+		if err := moveSlotStock(tx, movement); err != nil {
+			return err
+		}
+		if err := syncInventoryFromSlots(tx, movement.MachineID, movement.ProductID); err != nil {
+			return err
+		}
+	} else {
+		if movement.Slot != "" {
+			return errSlotNotFound
+		}
+		inventory := models.Inventory{}
+		record = tx.Where("machine_id = ? AND product_id = ?", movement.MachineID, movement.ProductID).Limit(1).Find(&inventory)
+		if record.Error != nil {
+			return record.Error
+		}
+		inventory.MachineID = movement.MachineID
+		inventory.ProductID = movement.ProductID
+		inventory.Available += movement.Quantity
+		if inventory.Available < 0 {
+			return errNotEnoughStock
+		}
+		record = tx.Save(&inventory)
+		if record.Error != nil {
+			return record.Error
+		}
+	}
+
+	return tx.Create(movement).Error
+}
+
+func moveSlotStock(tx *gorm.DB, movement *models.StockMovement) error {
+	if movement.Slot == "" {
+		if movement.Quantity > 0 {
+			return errSlotRequired
+		}
+		inventory := models.Inventory{}
+		record := tx.Where("machine_id = ? AND product_id = ?", movement.MachineID, movement.ProductID).First(&inventory)
+		if record.Error != nil {
+			return record.Error
+		}
+		if inventory.Available < -movement.Quantity {
+			return errNotEnoughStock
+		}
+		return drainSlots(tx, movement.MachineID, movement.ProductID, -movement.Quantity)
+	}
+
+	slot := models.Slot{}
+	record := tx.Where("machine_id = ? AND code = ? AND product_id = ?", movement.MachineID, movement.Slot, movement.ProductID).First(&slot)
+	if errors.Is(record.Error, gorm.ErrRecordNotFound) {
+		return errSlotNotFound
+	}
+	if record.Error != nil {
+		return record.Error
+	}
+
+	fill := slot.Fill + movement.Quantity
+	if fill < 0 {
+		return errNotEnoughStock
+	}
+	if fill > slot.Capacity {
+		return errSlotCapacity
+	}
+	return tx.Model(&slot).Update("fill", fill).Error
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// locales are a language code with an optional region, e.g. hr or de-AT
+var localePattern = regexp.MustCompile(`^[a-z]{2}(-[A-Z]{2})?$`)
+
+type TranslationRequest struct {
+	Name        string `json:"name" binding:"required,min=2,max=60"`
+	Description string `json:"description" binding:"max=500"`
+}
+
+func GetProductTranslations(context *gin.Context) {
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	translations := []models.ProductTranslation{}
+	record := database.Instance.Where("product_id = ?", productID).Order("locale").Find(&translations)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product_id": productID, "translations": translations})
+}
+
+func SetProductTranslation(context *gin.Context) {
+	token := auth.GetToken(context)
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+	locale, ok := normalizeLocale(context.Param("locale"))
+	if !ok {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid locale"})
+		return
+	}
+
+	var rq TranslationRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	translation := models.ProductTranslation{
+		ProductID:   productID,
+		Locale:      locale,
+		Name:        rq.Name,
+		Description: rq.Description,
+	}
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		if err := touchProduct(tx, productID, claims.UserID); err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "product_id"}, {Name: "locale"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "description", "updated_at", "deleted_at"}),
+		}).Create(&translation).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this product"})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product_id": productID, "locale": locale})
+}
+
+func DeleteProductTranslation(context *gin.Context) {
+	token := auth.GetToken(context)
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+	locale, ok := normalizeLocale(context.Param("locale"))
+	if !ok {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid locale"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		if err := touchProduct(tx, productID, claims.UserID); err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("product_id = ? AND locale = ?", productID, locale).Delete(&models.ProductTranslation{}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		context.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "you dont have permissions to update this product"})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product_id": productID, "locale": locale})
+}
+
+// touchProduct bumps the version of a seller's product so that its ETag
+// changes along with its translations.
+func touchProduct(tx *gorm.DB, productID uuid.UUID, sellerID uuid.UUID) error {
+	record := tx.Model(&models.Product{}).Where("id = ? AND seller_id = ?", productID, sellerID).Update("version", gorm.Expr("version + 1"))
+	if record.Error != nil {
+		return record.Error
+	}
+	if record.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// localizeProducts replaces the name and description of count products
+// with the best translation for the locales the request asks for.
+func localizeProducts(context *gin.Context, count int, product func(i int) *models.Product) error {
+	locales := requestedLocales(context)
+	if len(locales) == 0 || count == 0 {
+		return nil
+	}
+
+	ids := make([]uuid.UUID, count)
+	for i := 0; i < count; i++ {
+		ids[i] = product(i).ID
+	}
+	translations := []models.ProductTranslation{}
+	record := database.Instance.Where("product_id IN ? AND locale IN ?", ids, locales).Find(&translations)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	byProduct := map[uuid.UUID]map[string]models.ProductTranslation{}
+	for _, translation := range translations {
+		if byProduct[translation.ProductID] == nil {
+			byProduct[translation.ProductID] = map[string]models.ProductTranslation{}
+		}
+		byProduct[translation.ProductID][translation.Locale] = translation
+	}
+
+	for i := 0; i < count; i++ {
+		p := product(i)
+		for _, locale := range locales {
+			translation, ok := byProduct[p.ID][locale]
+			if !ok {
+				continue
+			}
+			p.Name = translation.Name
+			if translation.Description != "" {
+				p.Description = translation.Description
+			}
+			p.Locale = locale
+			break
+		}
+	}
+	return nil
+}
+
+// requestedLocales returns the fallback chain for a request: the lang query
+// parameter or else the Accept-Language entries by preference, each region
+// specific locale followed by its language.
+func requestedLocales(context *gin.Context) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	entries := []weighted{}
+	if lang := context.Query("lang"); lang != "" {
+		entries = append(entries, weighted{lang, 1})
+	} else {
+		for _, part := range strings.Split(context.GetHeader("Accept-Language"), ",") {
+			fields := strings.Split(strings.TrimSpace(part), ";")
+			entry := weighted{fields[0], 1}
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						entry.q = q
+					}
+				}
+			}
+			if entry.q > 0 {
+				entries = append(entries, entry)
+			}
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	}
+
+	locales := []string{}
+	seen := map[string]bool{}
+	add := func(locale string) {
+		if !seen[locale] {
+			seen[locale] = true
+			locales = append(locales, locale)
+		}
+	}
+	for _, entry := range entries {
+		locale, ok := normalizeLocale(entry.locale)
+		if !ok {
+			continue
+		}
+		add(locale)
+		add(locale[:2])
+	}
+	return locales
+}
+
+func normalizeLocale(value string) (string, bool) {
+	parts := strings.SplitN(strings.ReplaceAll(strings.TrimSpace(value), "_", "-"), "-", 2)
+	locale := strings.ToLower(parts[0])
+	if len(parts) == 2 {
+		locale += "-" + strings.ToUpper(parts[1])
+	}
+	return locale, localePattern.MatchString(locale)
+}
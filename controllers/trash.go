@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errProductInSlots  = errors.New("product is still placed in machine slots")
+	errProductStocked  = errors.New("product is still stocked in machines")
+	errProductReserved = errors.New("product is still reserved by buyers")
+)
+
+func GetTrashedProducts(context *gin.Context) {
+	token := auth.GetToken(context)
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	products := []models.Product{}
+	record := database.Instance.Unscoped().Where("seller_id = ? AND deleted_at IS NOT NULL", claims.UserID).Order("deleted_at DESC").Find(&products)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"products": products})
+}
+
+func RestoreProduct(context *gin.Context) {
+	token := auth.GetToken(context)
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	product := models.Product{}
+	record := database.Instance.Unscoped().Where("id = ? AND seller_id = ? AND deleted_at IS NOT NULL", productID, claims.UserID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not found in trash"})
+		return
+	}
+
+	var taken int64
+	record = database.Instance.Model(&models.Product{}).Where("name = ?", product.Name).Count(&taken)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if taken > 0 {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a product with this name already exists"})
+		return
+	}
+
+	record = database.Instance.Unscoped().Model(&models.Product{}).Where("id = ? AND deleted_at IS NOT NULL", productID).Updates(map[string]interface{}{
+		"deleted_at": nil,
+		"version":    gorm.Expr("version + 1"),
+	})
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	product.Version++
+	context.Header("ETag", productETag(product))
+	context.JSON(http.StatusOK, gin.H{"product_id": productID, "version": product.Version})
+}
+
+func PurgeProduct(context *gin.Context) {
+	token := auth.GetToken(context)
+	productID, err := uuid.Parse(context.Param("id"))
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid product id"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	product := models.Product{}
+	record := database.Instance.Unscoped().Where("id = ? AND seller_id = ? AND deleted_at IS NOT NULL", productID, claims.UserID).First(&product)
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "product not found in trash"})
+		return
+	}
+
+	// the stock movement ledger is kept, it is append-only
+	err = database.Instance.Transaction(func(tx *gorm.DB) error {
+		var slots int64
+		record := tx.Model(&models.Slot{}).Where("product_id = ?", productID).Count(&slots)
+		if record.Error != nil {
+			return record.Error
+		}
+		if slots > 0 {
+			return errProductInSlots
+		}
+		// stock can only leave a machine through a stock movement, so it has
+		// to be taken out before the inventory goes
+		inventories := []models.Inventory{}
+		record = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("product_id = ?", productID).Find(&inventories)
+		if record.Error != nil {
+			return record.Error
+		}
+		for _, inventory := range inventories {
+			if inventory.Available > 0 {
+				return errProductStocked
+			}
+		}
+		var reserved int64
+		record = tx.Model(&models.Reservation{}).Where("product_id = ? AND released_at IS NULL AND expires_at > ?", productID, time.Now()).Count(&reserved)
+		if record.Error != nil {
+			return record.Error
+		}
+		if reserved > 0 {
+			return errProductReserved
+		}
+		if err := tx.Unscoped().Where("product_id = ?", productID).Delete(&models.StockBatch{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", productID).Delete(&models.Reservation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", productID).Delete(&models.StockAlert{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("product_id = ?", productID).Delete(&models.ProductTranslation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("product_id = ?", productID).Delete(&models.Inventory{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("product_id = ?", productID).Delete(&models.Promotion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("product_id = ?", productID).Delete(&models.ProductPrice{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&product).Error
+	})
+	if errors.Is(err, errProductInSlots) || errors.Is(err, errProductStocked) || errors.Is(err, errProductReserved) {
+		context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"product_id": productID})
+}
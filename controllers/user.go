@@ -34,22 +34,15 @@ func RegisterUser(context *gin.Context) {
 	}
 
 	user.ID = uuid.New()
+	user.DateOfBirth = nil
+	user.AgeVerifiedAt = nil
+	user.AgeVerifiedBy = uuid.Nil
 	record := database.Instance.Create(&user)
 	if record.Error != nil {
 		context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
 		context.Abort()
 		return
 	}
-	if user.Role == models.Buyer {
-		balance := models.Balance{UserID: user.ID}
-		record = database.Instance.Create(&balance)
-		if record.Error != nil {
-			context.JSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
-			context.Abort()
-			return
-		}
-	}
-
 	context.JSON(http.StatusCreated, gin.H{"userId": user.ID, "username": user.Username})
 }
 
@@ -208,3 +201,53 @@ func LogoutAll(context *gin.Context) {
 	}
 	context.JSON(http.StatusOK, gin.H{"ok": true})
 }
+
+type VerifyAgeRequest struct {
+	UserID      uuid.UUID `json:"user_id" binding:"required"`
+	DateOfBirth string    `json:"date_of_birth" binding:"required,datetime=2006-01-02"`
+}
+
+func VerifyAge(context *gin.Context) {
+	token := auth.GetToken(context)
+	var rq VerifyAgeRequest
+	if err := context.ShouldBindJSON(&rq); err != nil {
+		var ve validator.ValidationErrors
+		if errors.As(err, &ve) {
+			out := make([]ErrorMsg, len(ve))
+			for i, fe := range ve {
+				out[i] = ErrorMsg{fe.Field(), getErrorMsg(fe)}
+			}
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": out})
+		} else {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	dateOfBirth, _ := time.ParseInLocation("2006-01-02", rq.DateOfBirth, time.Local)
+	if dateOfBirth.After(time.Now()) {
+		context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "date of birth is in the future"})
+		return
+	}
+
+	claims, err := auth.GetClaimsFromToken(token)
+	if err != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := database.Instance.Model(&models.User{}).Where("id = ?", rq.UserID).Updates(map[string]interface{}{
+		"date_of_birth":   dateOfBirth,
+		"age_verified_at": time.Now(),
+		"age_verified_by": claims.UserID,
+	})
+	if record.Error != nil {
+		context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": record.Error.Error()})
+		return
+	}
+	if record.RowsAffected == 0 {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"user_id": rq.UserID, "verified": true})
+}
@@ -1,8 +1,16 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
 	"log"
+	"math/rand"
 	"mvpmatch/veding-machine/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -20,10 +28,236 @@ func Connect(connectionString string) {
 	log.Println("Connected to Database!")
 }
 
-func Migrate() {
+// serializableAttempts is how often a serializable transaction is tried
+// before its serialization failure is returned.
+const serializableAttempts = 10
+
+// Serializable runs fn in a serializable transaction, retrying it when
+// postgres aborts it because of a concurrent transaction.
+func Serializable(fn func(tx *gorm.DB) error) error {
+	for attempt := 1; ; attempt++ {
+		err := Instance.Transaction(fn, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		if err == nil || attempt == serializableAttempts || !retryable(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt*attempt)*10*time.Millisecond + time.Duration(rand.Intn(10))*time.Millisecond)
+	}
+}
+
+// retryable reports whether err is a serialization failure or deadlock,
+// after which the whole transaction can be run again.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+// Migrate creates and upgrades the schema. Rows from before currencies
+// existed are assigned defaultCurrency.
+func Migrate(defaultCurrency string) {
 	Instance.AutoMigrate(&models.User{})
 	Instance.AutoMigrate(&models.Session{})
 	Instance.AutoMigrate(&models.Product{})
-	Instance.AutoMigrate(&models.Balance{})
+	// product names only need to be unique among products that are not deleted
+	Instance.Exec("ALTER TABLE products DROP CONSTRAINT IF EXISTS products_name_key")
+	Instance.AutoMigrate(&models.Currency{})
+	addCurrencyKey("denominations", "value", defaultCurrency)
+	addCurrencyKey("balance_coins", "user_id, denomination", defaultCurrency)
+	Instance.AutoMigrate(&models.Denomination{})
+	Instance.AutoMigrate(&models.BalanceCoin{})
+	migrateLegacyBalances(defaultCurrency)
+	Instance.AutoMigrate(&models.Machine{})
+	Instance.AutoMigrate(&models.Inventory{})
+	Instance.AutoMigrate(&models.Slot{})
+	Instance.AutoMigrate(&models.StockMovement{})
+	migrateLegacyStock(defaultCurrency)
+	openStockMovements()
+	Instance.AutoMigrate(&models.StockAlert{})
+	Instance.AutoMigrate(&models.ProductPrice{})
+	openPriceHistory()
+	Instance.AutoMigrate(&models.Promotion{})
+	Instance.AutoMigrate(&models.Purchase{})
+	Instance.AutoMigrate(&models.StockBatch{})
+	Instance.AutoMigrate(&models.ProductTranslation{})
+	Instance.AutoMigrate(&models.Reservation{})
+	Instance.AutoMigrate(&models.Refund{})
+	Instance.AutoMigrate(&models.LedgerEntry{})
+	Instance.AutoMigrate(&models.CashBoxCoin{})
+	Instance.AutoMigrate(&models.IdempotencyKey{})
+	for _, table := range []string{"machines", "products", "purchases"} {
+		Instance.Exec("UPDATE "+table+" SET currency = ? WHERE currency IS NULL OR currency = ''", defaultCurrency)
+	}
 	log.Println("Database Migration Completed!")
 }
+
+// SeedAdmin creates the admin account from configuration if it does not
+// exist yet. Admins cannot register through the API.
+func SeedAdmin(username string, password string) error {
+	var count int64
+	record := Instance.Model(&models.User{}).Where("username = ?", username).Count(&count)
+	if record.Error != nil || count > 0 {
+		return record.Error
+	}
+
+	admin := models.User{ID: uuid.New(), Name: username, Username: username, Role: models.Admin}
+	if err := admin.HashPassword(password); err != nil {
+		return err
+	}
+	return Instance.Create(&admin).Error
+}
+
+// SeedCurrency stores a configured currency and its coin values when the
+// database doesn't know them yet. Afterwards the database is the source of
+// truth.
+func SeedCurrency(code string, minorUnits int, values []int) error {
+	currency := models.Currency{Code: code, MinorUnits: minorUnits}
+	record := Instance.Where("code = ?", code).FirstOrCreate(&currency)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	var count int64
+	record = Instance.Model(&models.Denomination{}).Where("currency = ?", code).Count(&count)
+	if record.Error != nil || count > 0 {
+		return record.Error
+	}
+	for _, value := range values {
+		if err := Instance.Create(&models.Denomination{Currency: code, Value: value}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCurrencyKey adds a currency column to a table keyed by coin value
+// before currencies existed and makes it part of the primary key.
+func addCurrencyKey(table string, key string, defaultCurrency string) {
+	if !Instance.Migrator().HasTable(table) || Instance.Migrator().HasColumn(table, "currency") {
+		return
+	}
+	err := Instance.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN currency varchar(3)").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("UPDATE "+table+" SET currency = ?", defaultCurrency).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("ALTER TABLE " + table + " ALTER COLUMN currency SET NOT NULL").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("ALTER TABLE " + table + " DROP CONSTRAINT IF EXISTS " + table + "_pkey").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE " + table + " ADD PRIMARY KEY (currency, " + key + ")").Error
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// openStockMovements records the stock of inventories from before stock
+// movements were tracked as an opening movement, so that the inventory
+// agrees with its ledger.
+func openStockMovements() {
+	record := Instance.Exec(`INSERT INTO stock_movements (created_at, machine_id, product_id, slot, kind, quantity, reason, actor_id, reference, lot_number)
+		SELECT NOW(), machine_id, product_id, '', ?, available, ?, ?, ?, '' FROM inventories
+		WHERE deleted_at IS NULL AND available <> 0 AND NOT EXISTS (
+			SELECT 1 FROM stock_movements WHERE stock_movements.machine_id = inventories.machine_id AND stock_movements.product_id = inventories.product_id
+		)`, models.MovementAdjustment, models.ReasonOpening, uuid.Nil, uuid.Nil)
+	if record.Error != nil {
+		log.Println(record.Error)
+	}
+}
+
+// openPriceHistory starts the price history of products from before prices
+// were tracked with their current price.
+func openPriceHistory() {
+	record := Instance.Exec(`INSERT INTO product_prices (created_at, product_id, price, effective_from, applied)
+		SELECT NOW(), id, price, NOW(), true FROM products
+		WHERE NOT EXISTS (SELECT 1 FROM product_prices WHERE product_prices.product_id = products.id AND product_prices.applied)`)
+	if record.Error != nil {
+		log.Println(record.Error)
+	}
+}
+
+// migrateLegacyStock moves the stock products kept before stock was kept
+// per machine into an offline "legacy" machine of each seller, recorded as
+// opening stock, and drops the old column. Sellers transfer it from there
+// into the machines it is actually in. The service doesn't start while the
+// stock can't be moved, as it would be lost.
+func migrateLegacyStock(defaultCurrency string) {
+	if !Instance.Migrator().HasColumn("products", "available") {
+		return
+	}
+	type legacyStock struct {
+		ID        uuid.UUID
+		SellerID  uuid.UUID
+		Available int
+	}
+	err := Instance.Transaction(func(tx *gorm.DB) error {
+		stock := []legacyStock{}
+		record := tx.Raw("SELECT id, seller_id, available FROM products WHERE available > 0 ORDER BY seller_id").Scan(&stock)
+		if record.Error != nil {
+			return record.Error
+		}
+		machines := map[uuid.UUID]uuid.UUID{}
+		for _, product := range stock {
+			machineID, ok := machines[product.SellerID]
+			if !ok {
+				machine := models.Machine{
+					ID:         uuid.New(),
+					Serial:     "legacy" + strings.ReplaceAll(product.SellerID.String(), "-", "")[:24],
+					Location:   "legacy stock",
+					Status:     models.MachineOffline,
+					Currency:   defaultCurrency,
+					OperatorID: product.SellerID,
+				}
+				if err := tx.Create(&machine).Error; err != nil {
+					return err
+				}
+				machineID = machine.ID
+				machines[product.SellerID] = machineID
+			}
+			inventory := models.Inventory{MachineID: machineID, ProductID: product.ID, Available: product.Available}
+			if err := tx.Create(&inventory).Error; err != nil {
+				return err
+			}
+			movement := models.StockMovement{
+				MachineID: machineID,
+				ProductID: product.ID,
+				Kind:      models.MovementAdjustment,
+				Quantity:  product.Available,
+				Reason:    models.ReasonOpening,
+			}
+			if err := tx.Create(&movement).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Migrator().DropColumn("products", "available")
+	})
+	if err != nil {
+		log.Fatalf("moving the stock of products into machines: %s", err)
+	}
+}
+
+// migrateLegacyBalances moves balances from the old table with one column
+// per coin into balance_coins rows and drops the old table.
+func migrateLegacyBalances(defaultCurrency string) {
+	if !Instance.Migrator().HasColumn("balances", "five") {
+		return
+	}
+	err := Instance.Transaction(func(tx *gorm.DB) error {
+		for value, column := range map[int]string{5: "five", 10: "ten", 20: "twenty", 50: "fifty", 100: "hundred"} {
+			record := tx.Exec("INSERT INTO balance_coins (user_id, currency, denomination, count) SELECT user_id, ?, ?, "+column+" FROM balances WHERE "+column+" > 0 ON CONFLICT DO NOTHING", defaultCurrency, value)
+			if record.Error != nil {
+				return record.Error
+			}
+		}
+		return tx.Migrator().DropTable("balances")
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,100 @@
+package idempotency
+
+import (
+	"log"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// TTL is how long a stored response is replayed for.
+var TTL = 24 * time.Hour
+
+// StuckAfter is how long a request may run with a key before the key is
+// reported as stuck. A stuck key belongs to a request that died, e.g. with
+// its instance, or whose response couldn't be stored. Its request may have
+// committed, so the key is never claimed again on its own: an operator has
+// to check the request and Release the key.
+var StuckAfter = 60 * time.Second
+
+// Begin claims key for a request. It returns true when the caller should run
+// the request, otherwise the entry stored for the key by an earlier request,
+// which may still be running.
+func Begin(userID uuid.UUID, key string, fingerprint string) (models.IdempotencyKey, bool, error) {
+	now := time.Now()
+	record := database.Instance.
+		Where("user_id = ? AND key = ?", userID, key).
+		Where("expires_at <= ? AND status <> 0", now).
+		Delete(&models.IdempotencyKey{})
+	if record.Error != nil {
+		return models.IdempotencyKey{}, false, record.Error
+	}
+
+	entry := models.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(TTL),
+	}
+	record = database.Instance.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry)
+	if record.Error != nil {
+		return entry, false, record.Error
+	}
+	if record.RowsAffected == 1 {
+		return entry, true, nil
+	}
+
+	stored := models.IdempotencyKey{}
+	record = database.Instance.Where("user_id = ? AND key = ?", userID, key).First(&stored)
+	return stored, false, record.Error
+}
+
+// Complete stores the response to replay for the key.
+func Complete(entry models.IdempotencyKey, status int, contentType string, body []byte) error {
+	return database.Instance.Model(&models.IdempotencyKey{}).
+		Where("user_id = ? AND key = ?", entry.UserID, entry.Key).
+		Updates(map[string]interface{}{"status": status, "content_type": contentType, "body": body}).Error
+}
+
+// Abandon releases the key so the request can be retried with it, used when
+// the request failed without a result worth replaying.
+func Abandon(entry models.IdempotencyKey) error {
+	return database.Instance.Where("user_id = ? AND key = ?", entry.UserID, entry.Key).Delete(&models.IdempotencyKey{}).Error
+}
+
+// Stuck lists the keys in progress for longer than StuckAfter.
+func Stuck() ([]models.IdempotencyKey, error) {
+	stuck := []models.IdempotencyKey{}
+	record := database.Instance.Where("status = 0 AND created_at <= ?", time.Now().Add(-StuckAfter)).Order("created_at").Find(&stuck)
+	return stuck, record.Error
+}
+
+// Release frees a stuck key after an operator checked that its request
+// didn't go through, so it can be retried with the key.
+func Release(userID uuid.UUID, key string) (bool, error) {
+	record := database.Instance.
+		Where("user_id = ? AND key = ? AND status = 0 AND created_at <= ?", userID, key, time.Now().Add(-StuckAfter)).
+		Delete(&models.IdempotencyKey{})
+	return record.RowsAffected == 1, record.Error
+}
+
+// PurgeExpired deletes every stored response past its TTL and logs the
+// stuck keys, which are kept until an operator releases them.
+func PurgeExpired() error {
+	record := database.Instance.Where("expires_at <= ? AND status <> 0", time.Now()).Delete(&models.IdempotencyKey{})
+	if record.Error != nil {
+		return record.Error
+	}
+	stuck, err := Stuck()
+	if err != nil {
+		return err
+	}
+	for _, entry := range stuck {
+		log.Printf("idempotency key %s of user %s is stuck since %s", entry.Key, entry.UserID, entry.CreatedAt)
+	}
+	return nil
+}
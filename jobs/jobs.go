@@ -0,0 +1,19 @@
+package jobs
+
+import (
+	"log"
+	"time"
+)
+
+// Every runs job in the background once per interval, logging failures.
+func Every(interval time.Duration, name string, job func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := job(); err != nil {
+				log.Printf("%s: %s", name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package ledger
+
+import (
+	"fmt"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+
+	"github.com/google/uuid"
+)
+
+// Discrepancy is a ledger total that doesn't match the state it describes.
+type Discrepancy struct {
+	Check     string    `json:"check"`
+	AccountID uuid.UUID `json:"account_id"`
+	Currency  string    `json:"currency"`
+	Ledger    int       `json:"ledger"`
+	Actual    int       `json:"actual"`
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s %s %s: ledger %d, actual %d", d.Check, d.AccountID, d.Currency, d.Ledger, d.Actual)
+}
+
+// Check verifies that every transaction balances, that every wallet equals
+// the buyer's deposited coins, that every seller's revenue equals their
+// recorded purchases and that every cash box equals the coins the machine
+// holds. Deposits not made at a machine have no cash box to check.
+func Check() ([]Discrepancy, error) {
+	discrepancies := []Discrepancy{}
+
+	unbalanced := []Discrepancy{}
+	record := database.Instance.Model(&models.LedgerEntry{}).
+		Select("'unbalanced transaction' AS \"check\", transaction_id AS account_id, currency, SUM(amount) AS ledger, 0 AS actual").
+		Group("transaction_id, currency").
+		Having("SUM(amount) <> 0").
+		Scan(&unbalanced)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	discrepancies = append(discrepancies, unbalanced...)
+
+	wallets := []Discrepancy{}
+	record = database.Instance.Raw(`
+		SELECT 'wallet' AS "check", COALESCE(l.account_id, b.user_id) AS account_id, COALESCE(l.currency, b.currency) AS currency,
+			COALESCE(l.total, 0) AS ledger, COALESCE(b.total, 0) AS actual
+		FROM (SELECT account_id, currency, -SUM(amount) AS total FROM ledger_entries WHERE account_type = ? GROUP BY account_id, currency) l
+		FULL OUTER JOIN (SELECT user_id, currency, SUM(denomination * count) AS total FROM balance_coins GROUP BY user_id, currency) b
+			ON l.account_id = b.user_id AND l.currency = b.currency
+		WHERE COALESCE(l.total, 0) <> COALESCE(b.total, 0)`, models.AccountWallet).
+		Scan(&wallets)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	discrepancies = append(discrepancies, wallets...)
+
+	revenue := []Discrepancy{}
+	record = database.Instance.Raw(`
+		SELECT 'revenue' AS "check", COALESCE(l.account_id, p.seller_id) AS account_id, COALESCE(l.currency, p.currency) AS currency,
+			COALESCE(l.total, 0) AS ledger, COALESCE(p.total, 0) AS actual
+		FROM (SELECT account_id, currency, -SUM(amount) AS total FROM ledger_entries WHERE account_type = ? GROUP BY account_id, currency) l
+		FULL OUTER JOIN (SELECT seller_id, currency, SUM(total) AS total FROM purchases GROUP BY seller_id, currency) p
+			ON l.account_id = p.seller_id AND l.currency = p.currency
+		WHERE COALESCE(l.total, 0) <> COALESCE(p.total, 0)`, models.AccountRevenue).
+		Scan(&revenue)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	discrepancies = append(discrepancies, revenue...)
+
+	cashBoxes := []Discrepancy{}
+	record = database.Instance.Raw(`
+		SELECT 'cash box' AS "check", COALESCE(l.account_id, c.machine_id) AS account_id, COALESCE(l.currency, c.currency) AS currency,
+			COALESCE(l.total, 0) AS ledger, COALESCE(c.total, 0) AS actual
+		FROM (SELECT account_id, currency, SUM(amount) AS total FROM ledger_entries WHERE account_type = ? AND account_id <> ? GROUP BY account_id, currency) l
+		FULL OUTER JOIN (SELECT machine_id, currency, SUM(denomination * count) AS total FROM cash_box_coins GROUP BY machine_id, currency) c
+			ON l.account_id = c.machine_id AND l.currency = c.currency
+		WHERE COALESCE(l.total, 0) <> COALESCE(c.total, 0)`, models.AccountCashBox, uuid.Nil).
+		Scan(&cashBoxes)
+	if record.Error != nil {
+		return nil, record.Error
+	}
+	discrepancies = append(discrepancies, cashBoxes...)
+
+	return discrepancies, nil
+}
@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrUnbalanced = errors.New("ledger transaction does not balance")
+
+// Posting is one side of a ledger transaction.
+type Posting struct {
+	AccountType string
+	AccountID   uuid.UUID
+	Amount      int
+}
+
+func Debit(accountType string, accountID uuid.UUID, amount int) Posting {
+	return Posting{accountType, accountID, amount}
+}
+
+func Credit(accountType string, accountID uuid.UUID, amount int) Posting {
+	return Posting{accountType, accountID, -amount}
+}
+
+// Record writes a balanced transaction. Postings of zero are left out.
+func Record(tx *gorm.DB, kind string, currency string, reference uuid.UUID, postings ...Posting) error {
+	sum := 0
+	entries := []models.LedgerEntry{}
+	transactionID := uuid.New()
+	now := time.Now()
+	for _, posting := range postings {
+		sum += posting.Amount
+		if posting.Amount == 0 {
+			continue
+		}
+		entries = append(entries, models.LedgerEntry{
+			CreatedAt:     now,
+			TransactionID: transactionID,
+			Kind:          kind,
+			Reference:     reference,
+			AccountType:   posting.AccountType,
+			AccountID:     posting.AccountID,
+			Currency:      currency,
+			Amount:        posting.Amount,
+		})
+	}
+	if sum != 0 {
+		return ErrUnbalanced
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return tx.Create(&entries).Error
+}
+
+// Deposit records coins a buyer inserted into a machine.
+func Deposit(tx *gorm.DB, buyerID uuid.UUID, machineID uuid.UUID, currency string, amount int) error {
+	return Record(tx, models.LedgerDeposit, currency, uuid.Nil,
+		Debit(models.AccountCashBox, machineID, amount),
+		Credit(models.AccountWallet, buyerID, amount),
+	)
+}
+
+// Purchase records a sale paid from the buyer's wallet and the change
+// handed back out of the machine's cash box.
+func Purchase(tx *gorm.DB, purchase models.Purchase, change int) error {
+	err := Record(tx, models.LedgerPurchase, purchase.Currency, purchase.ID,
+		Debit(models.AccountWallet, purchase.BuyerID, purchase.Total),
+		Credit(models.AccountRevenue, purchase.SellerID, purchase.Total),
+	)
+	if err != nil {
+		return err
+	}
+	return payOut(tx, models.LedgerChange, purchase.BuyerID, purchase.MachineID, purchase.Currency, change, purchase.ID)
+}
+
+// Refund records a reset deposit handed back to the buyer.
+func Refund(tx *gorm.DB, refund models.Refund, machineID uuid.UUID) error {
+	return payOut(tx, models.LedgerRefund, refund.UserID, machineID, refund.Currency, refund.Amount, refund.ID)
+}
+
+// CashBox records coins an operator put into a machine's cash box, or took
+// out of it when amount is negative.
+func CashBox(tx *gorm.DB, machineID uuid.UUID, operatorID uuid.UUID, currency string, amount int) error {
+	kind := models.LedgerFloat
+	if amount < 0 {
+		kind = models.LedgerCollect
+	}
+	return Record(tx, kind, currency, uuid.Nil,
+		Debit(models.AccountCashBox, machineID, amount),
+		Credit(models.AccountOperator, operatorID, amount),
+	)
+}
+
+// payOut records coins handed back to a buyer out of a machine's cash box.
+func payOut(tx *gorm.DB, kind string, buyerID uuid.UUID, machineID uuid.UUID, currency string, amount int, reference uuid.UUID) error {
+	return Record(tx, kind, currency, reference,
+		Debit(models.AccountWallet, buyerID, amount),
+		Credit(models.AccountCashBox, machineID, amount),
+	)
+}
+
+// OpenBalances records an opening transaction for every wallet that holds
+// coins but has no ledger entries yet, e.g. balances from before the ledger.
+func OpenBalances() error {
+	type opening struct {
+		UserID   uuid.UUID
+		Currency string
+		Total    int
+	}
+	openings := []opening{}
+	record := database.Instance.Model(&models.BalanceCoin{}).
+		Select("user_id, currency, SUM(denomination * count) AS total").
+		Where("NOT EXISTS (SELECT 1 FROM ledger_entries WHERE ledger_entries.account_type = ? AND ledger_entries.account_id = balance_coins.user_id AND ledger_entries.currency = balance_coins.currency)", models.AccountWallet).
+		Group("user_id, currency").
+		Having("SUM(denomination * count) > 0").
+		Scan(&openings)
+	if record.Error != nil {
+		return record.Error
+	}
+	for _, o := range openings {
+		err := Record(database.Instance, models.LedgerOpening, o.Currency, uuid.Nil,
+			Debit(models.AccountCashBox, uuid.Nil, o.Total),
+			Credit(models.AccountWallet, o.UserID, o.Total),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"mvpmatch/veding-machine/alerts"
+	"mvpmatch/veding-machine/coins"
 	"mvpmatch/veding-machine/config"
 	"mvpmatch/veding-machine/controllers"
 	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/idempotency"
+	"mvpmatch/veding-machine/jobs"
+	"mvpmatch/veding-machine/ledger"
 	"mvpmatch/veding-machine/middlewares"
 	"mvpmatch/veding-machine/models"
+	"mvpmatch/veding-machine/pricing"
+	"mvpmatch/veding-machine/reservations"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/gin-gonic/gin"
@@ -20,7 +27,37 @@ func main() {
 	}
 
 	database.Connect(c.DSN)
-	database.Migrate()
+	coins.Default = c.Currency
+	database.Migrate(c.Currency)
+	if c.AdminUsername != "" {
+		if err := database.SeedAdmin(c.AdminUsername, c.AdminPassword); err != nil {
+			panic(err)
+		}
+	}
+	if err := database.SeedCurrency(c.Currency, c.CurrencyMinorUnits, c.Coins); err != nil {
+		panic(err)
+	}
+	if err := coins.Load(); err != nil {
+		panic(err)
+	}
+	if err := ledger.OpenBalances(); err != nil {
+		panic(err)
+	}
+
+	alerts.Register(alerts.LogChannel{})
+	if c.AlertWebhookURL != "" {
+		alerts.Register(alerts.NewWebhookChannel(c.AlertWebhookURL))
+	}
+	jobs.Every(c.AlertInterval, "low stock alerts", alerts.EvaluateAll)
+	jobs.Every(c.PriceInterval, "scheduled prices", pricing.ApplyScheduled)
+
+	reservations.TTL = c.ReservationTTL
+	reservations.MaxTTL = c.ReservationMaxTTL
+	jobs.Every(c.ReservationInterval, "expired reservations", reservations.ReleaseExpired)
+
+	idempotency.TTL = c.IdempotencyTTL
+	idempotency.StuckAfter = c.IdempotencyStuck
+	jobs.Every(c.IdempotencyInterval, "expired idempotency keys", idempotency.PurgeExpired)
 
 	// Initialize Router
 	router := initRouter()
@@ -44,11 +81,54 @@ func initRouter() *gin.Engine {
 			secured.PUT("/product", middlewares.RoleGuard(models.Seller), controllers.CreateProduct)
 			secured.DELETE("/product", middlewares.RoleGuard(models.Seller), controllers.DeleteProduct)
 			secured.POST("/product", middlewares.RoleGuard(models.Seller), controllers.UpdateProduct)
-			secured.POST("/deposit", middlewares.RoleGuard(models.Buyer), controllers.Deposit)
+			secured.POST("/products/import", middlewares.RoleGuard(models.Seller), controllers.ImportProducts)
+			secured.GET("/products/export", middlewares.RoleGuard(models.Seller), controllers.ExportProducts)
+			secured.POST("/products/:id/prices", middlewares.RoleGuard(models.Seller), controllers.SchedulePrice)
+			secured.GET("/products/trash", middlewares.RoleGuard(models.Seller), controllers.GetTrashedProducts)
+			secured.POST("/products/:id/restore", middlewares.RoleGuard(models.Seller), controllers.RestoreProduct)
+			secured.DELETE("/products/trash/:id", middlewares.RoleGuard(models.Seller), controllers.PurgeProduct)
+			secured.PUT("/products/:id/translations/:locale", middlewares.RoleGuard(models.Seller), controllers.SetProductTranslation)
+			secured.DELETE("/products/:id/translations/:locale", middlewares.RoleGuard(models.Seller), controllers.DeleteProductTranslation)
+			secured.GET("/seller/products", middlewares.RoleGuard(models.Seller), controllers.GetSellerProducts)
+			secured.GET("/seller/dashboard", middlewares.RoleGuard(models.Seller), controllers.GetSellerDashboard)
+			secured.PUT("/promotion", middlewares.RoleGuard(models.Seller), controllers.CreatePromotion)
+			secured.DELETE("/promotion", middlewares.RoleGuard(models.Seller), controllers.DeletePromotion)
+			secured.POST("/deposit", middlewares.RoleGuard(models.Buyer), middlewares.Idempotency(), controllers.Deposit)
+			secured.POST("/deposit/batch", middlewares.RoleGuard(models.Buyer), middlewares.Idempotency(), controllers.DepositBatch)
 			secured.POST("/reset-deposit", middlewares.RoleGuard(models.Buyer), controllers.ResetDeposit)
-			secured.POST("/buy", middlewares.RoleGuard(models.Buyer), controllers.Buy)
+			secured.GET("/balance", middlewares.RoleGuard(models.Buyer), controllers.GetBalance)
+			secured.GET("/balance/stream", middlewares.RoleGuard(models.Buyer), controllers.StreamBalance)
+			secured.POST("/buy", middlewares.RoleGuard(models.Buyer), middlewares.Idempotency(), controllers.Buy)
+			secured.POST("/reservations", middlewares.RoleGuard(models.Buyer), controllers.CreateReservation)
+			secured.GET("/reservations", middlewares.RoleGuard(models.Buyer), controllers.GetReservations)
+			secured.DELETE("/reservations/:id", middlewares.RoleGuard(models.Buyer), controllers.CancelReservation)
+			secured.POST("/users/verify-age", middlewares.RoleGuard(models.Admin), controllers.VerifyAge)
+			secured.PUT("/currency", middlewares.RoleGuard(models.Admin), controllers.SetCurrency)
+			secured.GET("/idempotency-keys/stuck", middlewares.RoleGuard(models.Admin), controllers.GetStuckIdempotencyKeys)
+			secured.DELETE("/idempotency-keys/:user/:key", middlewares.RoleGuard(models.Admin), controllers.ReleaseIdempotencyKey)
+			secured.PUT("/machine", middlewares.RoleGuard(models.Seller), controllers.CreateMachine)
+			secured.POST("/machine", middlewares.RoleGuard(models.Seller), controllers.UpdateMachine)
+			secured.POST("/inventory", middlewares.RoleGuard(models.Seller), controllers.SetInventory)
+			secured.GET("/machines/:id/cash-box", middlewares.RoleGuard(models.Seller), controllers.GetCashBox)
+			secured.POST("/cash-box", middlewares.RoleGuard(models.Seller), controllers.AdjustCashBox)
+			secured.PUT("/slot", middlewares.RoleGuard(models.Seller), controllers.SetSlot)
+			secured.DELETE("/slot", middlewares.RoleGuard(models.Seller), controllers.DeleteSlot)
+			secured.POST("/restock", middlewares.RoleGuard(models.Seller), controllers.Restock)
+			secured.POST("/stock/adjust", middlewares.RoleGuard(models.Seller), controllers.AdjustStock)
+			secured.POST("/stock/transfer", middlewares.RoleGuard(models.Seller), controllers.TransferStock)
+			secured.GET("/stock/movements", middlewares.RoleGuard(models.Seller), controllers.GetStockMovements)
+			secured.GET("/stock/reconcile", middlewares.RoleGuard(models.Seller), controllers.ReconcileStock)
+			secured.POST("/stock/threshold", middlewares.RoleGuard(models.Seller), controllers.SetStockThreshold)
+			secured.GET("/stock/expiring", middlewares.RoleGuard(models.Seller), controllers.GetExpiringStock)
 		}
 		api.GET("/products", controllers.GetProducts)
+		api.GET("/products/:id", controllers.GetProduct)
+		api.GET("/products/:id/prices", controllers.GetProductPrices)
+		api.GET("/products/:id/translations", controllers.GetProductTranslations)
+		api.GET("/machines", controllers.GetMachines)
+		api.GET("/currencies", controllers.GetCurrencies)
+		api.GET("/promotions", controllers.GetPromotions)
+		api.GET("/machines/:id/planogram", controllers.GetPlanogram)
 	}
 	return router
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/coins"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/ledger"
+	"mvpmatch/veding-machine/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// testDSN names the environment variable with the postgres database the
+// integration tests run against. They are skipped when it is not set.
+const testDSN = "VEDING_MACHINE_TEST_PSQL_DSN"
+
+// errNotEnoughStock is the error Buy responds with when the stock ran out.
+const errNotEnoughStock = "not enough products"
+
+func setupDatabase(t *testing.T) {
+	dsn := os.Getenv(testDSN)
+	if dsn == "" {
+		t.Skip(testDSN + " is not set")
+	}
+	database.Connect(dsn)
+	coins.Default = "EUR"
+	database.Migrate(coins.Default)
+	if err := database.SeedCurrency(coins.Default, 2, []int{5, 10, 20, 50, 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coins.Load(); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+}
+
+// createUser stores a user with a valid session and returns an access token
+// for them.
+func createUser(t *testing.T, role int) (models.User, string) {
+	id := uuid.New()
+	name := "t" + id.String()[:18]
+	user := models.User{ID: id, Name: name, Username: name, Role: role}
+	if err := database.Instance.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	session := models.Session{UUID: uuid.New(), Valid: true, UserID: id}
+	if err := database.Instance.Create(&session).Error; err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.GenerateAccessJWT(user.Username, user.ID, user.Role, session.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+func request(router *gin.Engine, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestParallelBuy lets more buyers than there are products buy at the same
+// time, with too few coins in the cash box to give all of them change.
+func TestParallelBuy(t *testing.T) {
+	setupDatabase(t)
+	router := initRouter()
+
+	const (
+		buyers = 20
+		stock  = 5
+		price  = 50
+		floats = 3
+	)
+
+	seller, sellerToken := createUser(t, models.Seller)
+	machine := models.Machine{
+		ID:         uuid.New(),
+		Serial:     "t" + strconv.FormatInt(int64(uuid.New().ID()), 10),
+		Location:   "test",
+		Status:     models.MachineActive,
+		Currency:   coins.Default,
+		OperatorID: seller.ID,
+	}
+	if err := database.Instance.Create(&machine).Error; err != nil {
+		t.Fatal(err)
+	}
+	product := models.Product{
+		ID:       uuid.New(),
+		Price:    price,
+		Currency: coins.Default,
+		Name:     "t" + uuid.New().String()[:20],
+		SellerID: seller.ID,
+	}
+	if err := database.Instance.Create(&product).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(router, http.MethodPost, "/api/secured/restock", sellerToken, gin.H{"machine_id": machine.ID, "product_id": product.ID, "quantity": stock})
+	if w.Code != http.StatusOK {
+		t.Fatalf("restock: %d %s", w.Code, w.Body)
+	}
+	float := []int{}
+	for i := 0; i < floats; i++ {
+		float = append(float, 50)
+	}
+	w = request(router, http.MethodPost, "/api/secured/cash-box", sellerToken, gin.H{"machine_id": machine.ID, "coins": float})
+	if w.Code != http.StatusOK {
+		t.Fatalf("float cash box: %d %s", w.Code, w.Body)
+	}
+
+	// every buyer pays with a 100 coin and needs a 50 back
+	tokens := make([]string, buyers)
+	for i := range tokens {
+		_, tokens[i] = createUser(t, models.Buyer)
+		w := request(router, http.MethodPost, "/api/secured/deposit", tokens[i], gin.H{"amount": 100, "machine_id": machine.ID})
+		if w.Code != http.StatusOK {
+			t.Fatalf("deposit: %d %s", w.Code, w.Body)
+		}
+	}
+
+	type result struct {
+		Change []int  `json:"change"`
+		Error  string `json:"error"`
+		Code   string `json:"code"`
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sold    int
+		paidOut int
+	)
+	for _, token := range tokens {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			w := request(router, http.MethodPost, "/api/secured/buy", token, gin.H{"machine_id": machine.ID, "product_id": product.ID, "amount": 1})
+			var res result
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Error(err)
+				return
+			}
+			// a buyer who loses the race is turned away, the purchase must
+			// never fail with a server error such as a deadlock
+			if w.Code != http.StatusOK {
+				if w.Code != http.StatusConflict || (res.Code != "exact_change_required" && res.Error != errNotEnoughStock) {
+					t.Errorf("buy: %d %s", w.Code, w.Body)
+				}
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			sold++
+			for _, coin := range res.Change {
+				paidOut += coin
+			}
+		}(token)
+	}
+	wg.Wait()
+
+	inventory := models.Inventory{}
+	if err := database.Instance.Where("machine_id = ? AND product_id = ?", machine.ID, product.ID).First(&inventory).Error; err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Available < 0 {
+		t.Errorf("inventory is %d", inventory.Available)
+	}
+	// every buyer could pay, so products are sold until the stock or the
+	// change runs out
+	want := stock
+	if floats < want {
+		want = floats
+	}
+	if sold != want {
+		t.Errorf("sold %d products, want %d", sold, want)
+	}
+	if inventory.Available != stock-sold {
+		t.Errorf("inventory is %d after selling %d of %d", inventory.Available, sold, stock)
+	}
+
+	var purchases int64
+	database.Instance.Model(&models.Purchase{}).Where("machine_id = ?", machine.ID).Count(&purchases)
+	if int(purchases) != sold {
+		t.Errorf("%d purchases recorded for %d sales", purchases, sold)
+	}
+
+	box, err := coins.CashBox(database.Instance, machine.ID, coins.Default)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for denomination, count := range box {
+		if count < 0 {
+			t.Errorf("cash box holds %d coins of %d", count, denomination)
+		}
+	}
+	if want := floats*50 + buyers*100 - paidOut; box.Total() != want {
+		t.Errorf("cash box holds %d, want %d", box.Total(), want)
+	}
+	if paidOut != sold*50 {
+		t.Errorf("paid out %d in change for %d sales", paidOut, sold)
+	}
+
+	discrepancies, err := ledger.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, discrepancy := range discrepancies {
+		t.Error(discrepancy)
+	}
+}
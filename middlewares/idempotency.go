@@ -0,0 +1,111 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"mvpmatch/veding-machine/auth"
+	"mvpmatch/veding-machine/idempotency"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxIdempotencyKey = 255
+
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(data string) (int, error) {
+	w.body.WriteString(data)
+	return w.ResponseWriter.WriteString(data)
+}
+
+// Idempotency makes requests carrying an Idempotency-Key header safe to
+// retry: the first response is stored and replayed for the same key, and a
+// key reused with a different request is rejected. Server errors aren't
+// stored, so those requests can be retried with the same key. A key whose
+// request may have gone through without its response being stored stays in
+// progress until an operator releases it.
+func Idempotency() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		key := context.GetHeader("Idempotency-Key")
+		if key == "" {
+			context.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "idempotency key too long"})
+			return
+		}
+
+		claims, err := auth.GetClaimsFromToken(auth.GetToken(context))
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		body, err := io.ReadAll(context.Request.Body)
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		context.Request.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(context.Request.Method + " " + context.FullPath() + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		entry, claimed, err := idempotency.Begin(claims.UserID, key, fingerprint)
+		if err != nil {
+			context.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !claimed {
+			switch {
+			case entry.Fingerprint != fingerprint:
+				context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "idempotency key was used for a different request"})
+			case entry.Status == 0:
+				context.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this idempotency key is still in progress"})
+			default:
+				context.Header("Idempotent-Replayed", "true")
+				context.Data(entry.Status, entry.ContentType, entry.Body)
+				context.Abort()
+			}
+			return
+		}
+
+		// a handler that never finishes, e.g. because it panicked, may have
+		// committed before, so the key is left in progress for an operator
+		finished := false
+		defer func() {
+			if !finished {
+				log.Printf("idempotency key %s of user %s: request didn't finish, the key is stuck", key, claims.UserID)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: context.Writer}
+		context.Writer = writer
+		context.Next()
+		finished = true
+
+		status := writer.Status()
+		if status >= http.StatusInternalServerError {
+			err = idempotency.Abandon(entry)
+		} else {
+			err = idempotency.Complete(entry, status, writer.Header().Get("Content-Type"), writer.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("idempotency key %s of user %s: %s, the key is stuck", key, claims.UserID, err)
+		}
+	}
+}
@@ -2,11 +2,26 @@ package models
 
 import "github.com/google/uuid"
 
-type Balance struct {
-	UserID  uuid.UUID `json:"user_id"`
-	FIVE    int
-	TEN     int
-	TWENTY  int
-	FIFTY   int
-	HUNDRED int
+// Currency is an ISO 4217 currency the machines accept. Amounts are stored
+// in its minor unit, e.g. cents for EUR.
+type Currency struct {
+	Code       string `json:"code" gorm:"primarykey;size:3"`
+	MinorUnits int    `json:"minor_units"`
+}
+
+// Denomination is a coin value the machines accept for a currency, in the
+// currency's minor unit.
+type Denomination struct {
+	Currency string `json:"currency" gorm:"primarykey;size:3"`
+	Value    int    `json:"value" gorm:"primarykey;autoIncrement:false"`
+}
+
+// BalanceCoin is how many coins of one denomination a buyer has deposited.
+// MachineID is the machine they were inserted at, whose cash box holds them.
+type BalanceCoin struct {
+	UserID       uuid.UUID `json:"user_id" gorm:"primarykey"`
+	Currency     string    `json:"currency" gorm:"primarykey;size:3"`
+	Denomination int       `json:"denomination" gorm:"primarykey;autoIncrement:false"`
+	Count        int       `json:"count"`
+	MachineID    uuid.UUID `json:"machine_id"`
 }
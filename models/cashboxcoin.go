@@ -0,0 +1,11 @@
+package models
+
+import "github.com/google/uuid"
+
+// CashBoxCoin is how many coins of one denomination a machine holds.
+type CashBoxCoin struct {
+	MachineID    uuid.UUID `json:"machine_id" gorm:"primarykey"`
+	Currency     string    `json:"currency" gorm:"primarykey;size:3"`
+	Denomination int       `json:"denomination" gorm:"primarykey;autoIncrement:false"`
+	Count        int       `json:"count"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey remembers the response to a request sent with an
+// Idempotency-Key header so a retry gets the same response instead of
+// running the request again. Status is zero while the request is running.
+type IdempotencyKey struct {
+	UserID      uuid.UUID `json:"user_id" gorm:"primarykey"`
+	Key         string    `json:"key" gorm:"primarykey;size:255"`
+	Fingerprint string    `json:"fingerprint" gorm:"size:64"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"-"`
+	Body        []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`
+}
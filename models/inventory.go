@@ -0,0 +1,14 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Inventory struct {
+	gorm.Model
+	MachineID         uuid.UUID `json:"machine_id" gorm:"uniqueIndex:idx_inventory_machine_product"`
+	ProductID         uuid.UUID `json:"product_id" gorm:"uniqueIndex:idx_inventory_machine_product"`
+	Available         int       `json:"available"`
+	LowStockThreshold int       `json:"low_stock_threshold"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AccountWallet  = "wallet"
+	AccountCashBox = "cash_box"
+	AccountRevenue = "revenue"
+	// coins an operator puts into or takes out of a cash box
+	AccountOperator = "operator"
+)
+
+const (
+	LedgerOpening  = "opening"
+	LedgerDeposit  = "deposit"
+	LedgerPurchase = "purchase"
+	LedgerChange   = "change"
+	LedgerRefund   = "refund"
+	LedgerFloat    = "float"
+	LedgerCollect  = "collection"
+)
+
+// LedgerEntry is one side of an append-only double-entry posting. Amount is
+// signed: debits are positive, credits negative, and the entries of one
+// transaction always sum to zero. Wallet and revenue accounts are owed by
+// the operator, so their balance is the negated sum. Refunds are the
+// transactions that pay a wallet back out of a cash box.
+type LedgerEntry struct {
+	ID            uint      `json:"id" gorm:"primarykey"`
+	CreatedAt     time.Time `json:"created_at"`
+	TransactionID uuid.UUID `json:"transaction_id" gorm:"index"`
+	Kind          string    `json:"kind"`
+	Reference     uuid.UUID `json:"reference"`
+	AccountType   string    `json:"account_type" gorm:"index:idx_ledger_account"`
+	AccountID     uuid.UUID `json:"account_id" gorm:"index:idx_ledger_account"`
+	Currency      string    `json:"currency" gorm:"size:3;index:idx_ledger_account"`
+	Amount        int       `json:"amount"`
+}
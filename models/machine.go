@@ -0,0 +1,22 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	MachineActive = iota
+	MachineMaintenance
+	MachineOffline
+)
+
+type Machine struct {
+	gorm.Model
+	ID         uuid.UUID `json:"id"`
+	Serial     string    `json:"serial" gorm:"unique" binding:"required,alphanum,min=3,max=30"`
+	Location   string    `json:"location" binding:"required,min=2,max=100"`
+	Status     int       `json:"status" binding:"eq=0|eq=1|eq=2"`
+	Currency   string    `json:"currency" gorm:"size:3" binding:"omitempty,iso4217"`
+	OperatorID uuid.UUID `json:"operator_id"`
+}
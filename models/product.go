@@ -2,14 +2,42 @@ package models
 
 import (
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
+// EUAllergens are the 14 allergens that must be declared under EU
+// Regulation 1169/2011.
+var EUAllergens = []string{
+	"gluten", "crustaceans", "eggs", "fish", "peanuts", "soybeans", "milk",
+	"nuts", "celery", "mustard", "sesame", "sulphites", "lupin", "molluscs",
+}
+
 type Product struct {
 	gorm.Model
-	ID        uuid.UUID `json:"ID"`
-	Available int       `json:"available" binding:"min=1,max=99"`
-	Price     int       `json:"price" binding:"min=0,max=1000"`
-	Name      string    `json:"name" gorm:"unique" binding:"min=2,max=30"`
-	SellerID  uuid.UUID `json:"seller_id"`
+	ID          uuid.UUID      `json:"ID"`
+	Price       int            `json:"price" binding:"min=0"`
+	Currency    string         `json:"currency" gorm:"size:3" binding:"omitempty,iso4217"`
+	Name        string         `json:"name" gorm:"uniqueIndex:idx_products_name,where:deleted_at IS NULL" binding:"min=2,max=30"`
+	Category    string         `json:"category" binding:"max=30"`
+	SellerID    uuid.UUID      `json:"seller_id"`
+	MinimumAge  int            `json:"minimum_age" binding:"min=0,max=21"`
+	Allergens   pq.StringArray `json:"allergens" gorm:"type:text[];not null;default:'{}'" binding:"max=14,unique,dive,oneof=gluten crustaceans eggs fish peanuts soybeans milk nuts celery mustard sesame sulphites lupin molluscs"`
+	Description string         `json:"description" binding:"max=500"`
+	Ingredients string         `json:"ingredients" binding:"max=1000"`
+	Nutrition   Nutrition      `json:"nutrition" gorm:"embedded;embeddedPrefix:nutrition_"`
+	Version     int            `json:"version" gorm:"not null;default:1"`
+	Locale      string         `json:"locale,omitempty" gorm:"-"`
+}
+
+// Nutrition holds the nutrition facts of one serving. Weights are in grams.
+type Nutrition struct {
+	ServingSize   float64 `json:"serving_size" binding:"min=0,max=2000"`
+	EnergyKcal    float64 `json:"energy_kcal" binding:"min=0,max=5000"`
+	Fat           float64 `json:"fat" binding:"min=0,max=2000"`
+	SaturatedFat  float64 `json:"saturated_fat" binding:"min=0,ltefield=Fat"`
+	Carbohydrates float64 `json:"carbohydrates" binding:"min=0,max=2000"`
+	Sugars        float64 `json:"sugars" binding:"min=0,ltefield=Carbohydrates"`
+	Protein       float64 `json:"protein" binding:"min=0,max=2000"`
+	Salt          float64 `json:"salt" binding:"min=0,max=2000"`
 }
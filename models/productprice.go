@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProductPrice is one entry of a product's price history. Scheduled price
+// changes are stored with a future EffectiveFrom and are not Applied until
+// that time is reached.
+type ProductPrice struct {
+	ID            uint       `json:"id" gorm:"primarykey"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ProductID     uuid.UUID  `json:"product_id" gorm:"index"`
+	Price         int        `json:"price"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to"`
+	Applied       bool       `json:"applied"`
+}
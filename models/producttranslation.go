@@ -0,0 +1,14 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ProductTranslation struct {
+	gorm.Model
+	ProductID   uuid.UUID `json:"product_id" gorm:"uniqueIndex:idx_product_translation_locale"`
+	Locale      string    `json:"locale" gorm:"uniqueIndex:idx_product_translation_locale"`
+	Name        string    `json:"name" binding:"required,min=2,max=60"`
+	Description string    `json:"description" binding:"max=500"`
+}
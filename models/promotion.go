@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	PromotionPercentage = iota
+	PromotionBuyXPayY
+)
+
+// Promotion is a discount rule for the seller's products. It can target a
+// single product, a category or (with neither set) every product of the
+// seller, and can be limited to a validity period and a daily hour window.
+type Promotion struct {
+	gorm.Model
+	ID          uuid.UUID  `json:"id"`
+	SellerID    uuid.UUID  `json:"seller_id"`
+	Name        string     `json:"name" binding:"required,min=2,max=50"`
+	Kind        int        `json:"kind" binding:"eq=0|eq=1"`
+	ProductID   uuid.UUID  `json:"product_id"`
+	Category    string     `json:"category" binding:"max=30"`
+	Percent     int        `json:"percent" binding:"min=0,max=100"`
+	BuyQuantity int        `json:"buy_quantity" binding:"min=0,max=100"`
+	PayQuantity int        `json:"pay_quantity" binding:"min=0,max=100"`
+	StartHour   int        `json:"start_hour" binding:"min=0,max=24"`
+	EndHour     int        `json:"end_hour" binding:"min=0,max=24"`
+	ValidFrom   *time.Time `json:"valid_from"`
+	ValidTo     *time.Time `json:"valid_to"`
+}
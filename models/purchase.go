@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Purchase records a completed sale at the price actually paid, after
+// promotions.
+type Purchase struct {
+	ID        uuid.UUID `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	BuyerID   uuid.UUID `json:"buyer_id"`
+	SellerID  uuid.UUID `json:"seller_id" gorm:"index"`
+	MachineID uuid.UUID `json:"machine_id"`
+	ProductID uuid.UUID `json:"product_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	Total     int       `json:"total"`
+	Currency  string    `json:"currency" gorm:"size:3"`
+}
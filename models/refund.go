@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Refund records coins handed back to a buyer when they reset their
+// deposit.
+type Refund struct {
+	ID        uuid.UUID     `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time     `json:"created_at" gorm:"index"`
+	UserID    uuid.UUID     `json:"user_id" gorm:"index"`
+	Currency  string        `json:"currency" gorm:"size:3"`
+	Amount    int           `json:"amount"`
+	Coins     pq.Int64Array `json:"coins" gorm:"type:integer[]"`
+}
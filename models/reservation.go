@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reservation holds units of a product in a machine for one buyer until it
+// expires, is cancelled or is used by a purchase. Held units stay in the
+// inventory but cannot be bought by anyone else.
+type Reservation struct {
+	ID         uuid.UUID  `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	BuyerID    uuid.UUID  `json:"buyer_id" gorm:"index"`
+	MachineID  uuid.UUID  `json:"machine_id" gorm:"index:idx_reservation_machine_product"`
+	ProductID  uuid.UUID  `json:"product_id" gorm:"index:idx_reservation_machine_product"`
+	Quantity   int        `json:"quantity"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"index"`
+	ReleasedAt *time.Time `json:"released_at"`
+	PurchaseID *uuid.UUID `json:"purchase_id"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type Slot struct {
+	gorm.Model
+	MachineID uuid.UUID `json:"machine_id" gorm:"uniqueIndex:idx_slot_machine_code"`
+	Code      string    `json:"code" gorm:"uniqueIndex:idx_slot_machine_code"`
+	ProductID uuid.UUID `json:"product_id"`
+	Capacity  int       `json:"capacity"`
+	Fill      int       `json:"fill"`
+}
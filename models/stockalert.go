@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StockAlert is raised when a machine's stock of a product falls to its
+// low-stock threshold. At most one alert per machine and product is open
+// (unresolved) at a time.
+type StockAlert struct {
+	ID         uint       `json:"id" gorm:"primarykey"`
+	MachineID  uuid.UUID  `json:"machine_id" gorm:"uniqueIndex:idx_stock_alert_open,where:resolved_at IS NULL"`
+	ProductID  uuid.UUID  `json:"product_id" gorm:"uniqueIndex:idx_stock_alert_open,where:resolved_at IS NULL"`
+	Available  int        `json:"available"`
+	Threshold  int        `json:"threshold"`
+	RaisedAt   time.Time  `json:"raised_at"`
+	NotifiedAt *time.Time `json:"notified_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// StockBatch is a lot of a product received into a machine. Quantity is
+// what is left of the lot; batches are depleted first-in, first-out by
+// best-before date.
+type StockBatch struct {
+	gorm.Model
+	MachineID  uuid.UUID  `json:"machine_id" gorm:"index:idx_stock_batch_machine_product"`
+	ProductID  uuid.UUID  `json:"product_id" gorm:"index:idx_stock_batch_machine_product"`
+	LotNumber  string     `json:"lot_number"`
+	BestBefore *time.Time `json:"best_before"`
+	Quantity   int        `json:"quantity"`
+}
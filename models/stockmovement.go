@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MovementRestock = iota
+	MovementSale
+	MovementAdjustment
+	MovementWaste
+	MovementTransfer
+)
+
+const (
+	ReasonDelivery        = "delivery"
+	ReasonSale            = "sale"
+	ReasonCountCorrection = "count_correction"
+	ReasonPlanogram       = "planogram"
+	ReasonExpired         = "expired"
+	ReasonDamaged         = "damaged"
+	ReasonTheft           = "theft"
+	ReasonRebalance       = "rebalance"
+	ReasonOpening         = "opening"
+)
+
+// StockMovement is an append-only ledger entry. Quantity is signed: stock
+// leaving a machine is negative, stock entering it is positive.
+type StockMovement struct {
+	ID         uint       `json:"id" gorm:"primarykey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	MachineID  uuid.UUID  `json:"machine_id" gorm:"index"`
+	ProductID  uuid.UUID  `json:"product_id" gorm:"index"`
+	Slot       string     `json:"slot"`
+	Kind       int        `json:"kind"`
+	Quantity   int        `json:"quantity"`
+	Reason     string     `json:"reason"`
+	ActorID    uuid.UUID  `json:"actor_id"`
+	Reference  uuid.UUID  `json:"reference"`
+	LotNumber  string     `json:"lot_number"`
+	BestBefore *time.Time `json:"best_before"`
+}
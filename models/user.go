@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -9,15 +11,19 @@ import (
 const (
 	Buyer = iota
 	Seller
+	Admin
 )
 
 type User struct {
 	gorm.Model
-	ID       uuid.UUID `json:"id"`
-	Name     string    `json:"name" binding:"required,alpha,min=5,max=20"`
-	Username string    `json:"username" gorm:"unique" binding:"required,alphanum,min=5,max=20"`
-	Password string    `json:"password" binding:"required,alphanum,min=5,max=20"`
-	Role     int       `json:"role" binding:"eq=0|eq=1"`
+	ID            uuid.UUID  `json:"id"`
+	Name          string     `json:"name" binding:"required,alpha,min=5,max=20"`
+	Username      string     `json:"username" gorm:"unique" binding:"required,alphanum,min=5,max=20"`
+	Password      string     `json:"password" binding:"required,alphanum,min=5,max=20"`
+	Role          int        `json:"role" binding:"eq=0|eq=1"`
+	DateOfBirth   *time.Time `json:"date_of_birth"`
+	AgeVerifiedAt *time.Time `json:"age_verified_at"`
+	AgeVerifiedBy uuid.UUID  `json:"age_verified_by"`
 }
 
 func (user *User) HashPassword(password string) error {
@@ -29,6 +35,20 @@ func (user *User) HashPassword(password string) error {
 	return nil
 }
 
+// VerifiedAge returns the user's age at the given time and whether their
+// date of birth has been verified by an admin.
+func (user *User) VerifiedAge(at time.Time) (int, bool) {
+	if user.DateOfBirth == nil || user.AgeVerifiedAt == nil {
+		return 0, false
+	}
+	born := *user.DateOfBirth
+	age := at.Year() - born.Year()
+	if at.Month() < born.Month() || (at.Month() == born.Month() && at.Day() < born.Day()) {
+		age--
+	}
+	return age, true
+}
+
 func (user *User) CheckPassword(providedPassword string) error {
 	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(providedPassword))
 	if err != nil {
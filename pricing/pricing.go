@@ -0,0 +1,76 @@
+package pricing
+
+import (
+	"fmt"
+	"log"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RecordPrice starts a new price history entry for a product whose price
+// has just been set to price.
+func RecordPrice(tx *gorm.DB, productID uuid.UUID, price int) error {
+	entry := models.ProductPrice{
+		ProductID:     productID,
+		Price:         price,
+		EffectiveFrom: time.Now(),
+		Applied:       true,
+	}
+	record := tx.Create(&entry)
+	if record.Error != nil {
+		return record.Error
+	}
+	return closePrevious(tx, entry)
+}
+
+// Apply closes the product's current price entry, marks entry as applied
+// and copies its price onto the product, bumping the product version. An
+// entry another run has applied in the meantime is skipped.
+func Apply(tx *gorm.DB, entry models.ProductPrice) error {
+	record := tx.Model(&models.ProductPrice{}).Where("id = ? AND applied = ?", entry.ID, false).Update("applied", true)
+	if record.Error != nil || record.RowsAffected == 0 {
+		return record.Error
+	}
+	if err := closePrevious(tx, entry); err != nil {
+		return err
+	}
+	return tx.Model(&models.Product{}).Where("id = ?", entry.ProductID).Updates(map[string]interface{}{
+		"price":   entry.Price,
+		"version": gorm.Expr("version + 1"),
+	}).Error
+}
+
+func closePrevious(tx *gorm.DB, entry models.ProductPrice) error {
+	return tx.Model(&models.ProductPrice{}).
+		Where("product_id = ? AND applied = ? AND effective_to IS NULL AND id <> ?", entry.ProductID, true, entry.ID).
+		Update("effective_to", entry.EffectiveFrom).Error
+}
+
+// ApplyScheduled applies every scheduled price change that became due, each
+// in its own transaction, in the order they take effect. A change that
+// fails is logged and left for the next run, the others are still applied.
+func ApplyScheduled() error {
+	due := []models.ProductPrice{}
+	record := database.Instance.Where("applied = ? AND effective_from <= ?", false, time.Now()).Order("effective_from").Find(&due)
+	if record.Error != nil {
+		return record.Error
+	}
+	failed := 0
+	for _, entry := range due {
+		err := database.Instance.Transaction(func(tx *gorm.DB) error {
+			return Apply(tx, entry)
+		})
+		if err != nil {
+			log.Printf("scheduled price %d for product %s: %s", entry.ID, entry.ProductID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scheduled prices could not be applied", failed, len(due))
+	}
+	return nil
+}
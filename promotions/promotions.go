@@ -0,0 +1,95 @@
+package promotions
+
+import (
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Applied struct {
+	PromotionID uuid.UUID `json:"promotion_id"`
+	Name        string    `json:"name"`
+	Discount    int       `json:"discount"`
+}
+
+// ForProduct loads the seller's promotions that target product and are
+// within their validity period at the given time.
+func ForProduct(product models.Product, at time.Time) ([]models.Promotion, error) {
+	promotions := []models.Promotion{}
+	record := database.Instance.
+		Where("seller_id = ?", product.SellerID).
+		Where("(product_id = ? OR product_id = ?)", product.ID, uuid.Nil).
+		Where("(category = '' OR category = ?)", product.Category).
+		Where("(valid_from IS NULL OR valid_from <= ?) AND (valid_to IS NULL OR valid_to > ?)", at, at).
+		Find(&promotions)
+	return promotions, record.Error
+}
+
+// Price computes the cost of buying amount units of product under the given
+// promotions. The best quantity rule is applied first to the units paid
+// for, then the best percentage rule to what is left. The discounted cost
+// is rounded to the nearest multiple of the smallest coin.
+func Price(product models.Product, amount int, promotions []models.Promotion, at time.Time, smallestCoin int) (int, []Applied) {
+	full := product.Price * amount
+	cost := full
+	applied := []Applied{}
+
+	var bestQuantity *models.Promotion
+	bestQuantityCost := cost
+	for i, promotion := range promotions {
+		if promotion.Kind != models.PromotionBuyXPayY || !inWindow(promotion, at) {
+			continue
+		}
+		if promotion.BuyQuantity <= 0 || promotion.PayQuantity >= promotion.BuyQuantity {
+			continue
+		}
+		bundles := amount / promotion.BuyQuantity
+		paid := bundles*promotion.PayQuantity + amount%promotion.BuyQuantity
+		if paid*product.Price < bestQuantityCost {
+			bestQuantity = &promotions[i]
+			bestQuantityCost = paid * product.Price
+		}
+	}
+	if bestQuantity != nil {
+		applied = append(applied, Applied{bestQuantity.ID, bestQuantity.Name, cost - bestQuantityCost})
+		cost = bestQuantityCost
+	}
+
+	var bestPercentage *models.Promotion
+	for i, promotion := range promotions {
+		if promotion.Kind != models.PromotionPercentage || !inWindow(promotion, at) {
+			continue
+		}
+		if bestPercentage == nil || promotion.Percent > bestPercentage.Percent {
+			bestPercentage = &promotions[i]
+		}
+	}
+	if bestPercentage != nil && bestPercentage.Percent > 0 {
+		discount := cost * bestPercentage.Percent / 100
+		applied = append(applied, Applied{bestPercentage.ID, bestPercentage.Name, discount})
+		cost -= discount
+	}
+
+	if smallestCoin > 1 && len(applied) > 0 {
+		rounded := (cost + smallestCoin/2) / smallestCoin * smallestCoin
+		applied[len(applied)-1].Discount += cost - rounded
+		cost = rounded
+	}
+	return cost, applied
+}
+
+// inWindow reports whether at falls into the promotion's daily hour window.
+// Equal start and end hours mean the whole day; a start after the end
+// wraps around midnight.
+func inWindow(promotion models.Promotion, at time.Time) bool {
+	if promotion.StartHour == promotion.EndHour {
+		return true
+	}
+	hour := at.Hour()
+	if promotion.StartHour < promotion.EndHour {
+		return hour >= promotion.StartHour && hour < promotion.EndHour
+	}
+	return hour >= promotion.StartHour || hour < promotion.EndHour
+}
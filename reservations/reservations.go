@@ -0,0 +1,102 @@
+package reservations
+
+import (
+	"errors"
+	"mvpmatch/veding-machine/database"
+	"mvpmatch/veding-machine/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TTL is how long a reservation holds stock when the buyer doesn't ask for
+// a specific duration, MaxTTL the longest a buyer may ask for.
+var (
+	TTL    = 2 * time.Minute
+	MaxTTL = 10 * time.Minute
+)
+
+var ErrNotEnoughStock = errors.New("not enough unreserved products")
+
+// Held returns how many units of a product in a machine are held by active
+// reservations of buyers other than except.
+func Held(tx *gorm.DB, machineID uuid.UUID, productID uuid.UUID, except uuid.UUID) (int, error) {
+	held := 0
+	record := tx.Model(&models.Reservation{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("machine_id = ? AND product_id = ? AND buyer_id <> ? AND released_at IS NULL AND expires_at > ?", machineID, productID, except, time.Now()).
+		Scan(&held)
+	return held, record.Error
+}
+
+// Hold replaces the buyer's active reservation for the product in the
+// machine with a new one. The inventory row is locked so that two buyers
+// can't reserve the same last units.
+func Hold(tx *gorm.DB, reservation *models.Reservation) error {
+	inventory := models.Inventory{}
+	record := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("machine_id = ? AND product_id = ?", reservation.MachineID, reservation.ProductID).
+		First(&inventory)
+	if record.Error != nil {
+		return record.Error
+	}
+
+	held, err := Held(tx, reservation.MachineID, reservation.ProductID, reservation.BuyerID)
+	if err != nil {
+		return err
+	}
+	if reservation.Quantity > inventory.Available-held {
+		return ErrNotEnoughStock
+	}
+
+	if err := Release(tx, reservation.BuyerID, reservation.MachineID, reservation.ProductID); err != nil {
+		return err
+	}
+	return tx.Create(reservation).Error
+}
+
+// Release ends the buyer's active reservations for the product in the
+// machine.
+func Release(tx *gorm.DB, buyerID uuid.UUID, machineID uuid.UUID, productID uuid.UUID) error {
+	return tx.Model(&models.Reservation{}).
+		Where("buyer_id = ? AND machine_id = ? AND product_id = ? AND released_at IS NULL", buyerID, machineID, productID).
+		Update("released_at", time.Now()).Error
+}
+
+// Use takes the units of a purchase out of the buyer's active reservation
+// for the product in the machine. A reservation that is used up is released
+// with the purchase, one with units left keeps holding them.
+func Use(tx *gorm.DB, buyerID uuid.UUID, machineID uuid.UUID, productID uuid.UUID, quantity int, purchaseID uuid.UUID) error {
+	reservations := []models.Reservation{}
+	record := tx.Where("buyer_id = ? AND machine_id = ? AND product_id = ? AND released_at IS NULL AND expires_at > ?", buyerID, machineID, productID, time.Now()).
+		Order("expires_at").
+		Find(&reservations)
+	if record.Error != nil {
+		return record.Error
+	}
+	for _, reservation := range reservations {
+		if quantity == 0 {
+			return nil
+		}
+		if reservation.Quantity > quantity {
+			return tx.Model(&reservation).Update("quantity", reservation.Quantity-quantity).Error
+		}
+		record = tx.Model(&reservation).Updates(map[string]interface{}{"released_at": time.Now(), "purchase_id": purchaseID})
+		if record.Error != nil {
+			return record.Error
+		}
+		quantity -= reservation.Quantity
+	}
+	return nil
+}
+
+// ReleaseExpired releases every reservation that ran out, giving its units
+// back to other buyers.
+func ReleaseExpired() error {
+	now := time.Now()
+	return database.Instance.Model(&models.Reservation{}).
+		Where("released_at IS NULL AND expires_at <= ?", now).
+		Update("released_at", now).Error
+}